@@ -9,43 +9,128 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
+
+	"inet.af/peercred"
 )
 
 type Client struct {
 	c net.Conn
 
+	// mu protects gr, which Release may use while the Watch
+	// goroutine resets the streams.
+	mu sync.Mutex
 	gr *gob.Encoder
 	gw *gob.Decoder
+
+	// finalNotice indicates that the daemon supports
+	// ActionRelease.Wait, and released is closed when the Watch
+	// goroutine receives the final Notice or loses the connection.
+	finalNotice bool
+	released    chan struct{}
 }
 
-func NewClient(socketPath string) *Client {
+// releaseTimeout is how long Release waits for the daemon's final
+// Notice.
+const releaseTimeout = 5 * time.Second
+
+// NewClient connects to the daemon listening on socketPath. It
+// refuses to talk to a daemon that is not running as root or
+// daemonUID (if non-empty).
+func NewClient(socketPath, daemonUID string) *Client {
 	c, err := net.Dial("unix", socketPath)
 	if err != nil {
 		log.Print(err)
 		log.Fatal("Is the perflock daemon running?")
 	}
+	if err := verifyDaemon(c, daemonUID); err != nil {
+		log.Fatalf("%s: %v", socketPath, err)
+	}
 
-	gr, gw := gob.NewEncoder(c), gob.NewDecoder(c)
+	return &Client{c: c, gr: gob.NewEncoder(c), gw: gob.NewDecoder(unbufferedReader{c})}
+}
 
-	return &Client{c, gr, gw}
+// verifyDaemon checks that the process listening on the other end of
+// c is a daemon we trust. Otherwise, any user could bind the socket
+// first (which is easy for an abstract socket) and grant locks that
+// don't exclude anyone.
+func verifyDaemon(c net.Conn, daemonUID string) error {
+	cred, err := peercred.Get(c)
+	if err != nil {
+		return fmt.Errorf("checking daemon credentials: %w", err)
+	}
+	uid, ok := cred.UserID()
+	if !ok {
+		return fmt.Errorf("checking daemon credentials: no user ID")
+	}
+	if !trustDaemon(uid, daemonUID) {
+		return fmt.Errorf("daemon is running as UID %s, not root; refusing to trust it (use -daemon-user if this is expected)", uid)
+	}
+	return nil
 }
 
-func (c *Client) do(action PerfLockAction, response interface{}) {
+// trustDaemon returns whether to trust a daemon running as uid. We
+// trust root and daemonUID.
+func trustDaemon(uid, daemonUID string) bool {
+	return uid == "0" || uid == daemonUID
+}
+
+func (c *Client) send(action PerfLockAction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	err := c.gr.Encode(action)
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	err = c.gw.Decode(response)
+func (c *Client) do(action PerfLockAction, response interface{}) {
+	c.send(action)
+
+	err := c.gw.Decode(response)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func (c *Client) Acquire(shared, nonblocking bool, msg string) bool {
-	var ok bool
-	c.do(PerfLockAction{ActionAcquire{Shared: shared, NonBlocking: nonblocking, Msg: msg}}, &ok)
-	return ok
+// reset acknowledges a Reset from the daemon and starts new gob
+// streams for the daemon that is taking over the connection.
+func (c *Client) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.gr.Encode(PerfLockAction{ActionReset{}}); err != nil {
+		log.Fatal(err)
+	}
+	c.gr = gob.NewEncoder(c.c)
+	c.gw = gob.NewDecoder(unbufferedReader{c.c})
+}
+
+// Acquire acquires the lock. It returns false if the lock could not
+// be acquired without blocking, or an error if the daemon refused the
+// acquisition.
+func (c *Client) Acquire(shared, nonblocking bool, msg string) (bool, error) {
+	var resp AcquireResponse
+	c.send(PerfLockAction{ActionAcquire{Shared: shared, NonBlocking: nonblocking, Msg: msg, Handoff: true, Version: protocolVersion}})
+	if err := c.gw.Decode(&resp); err != nil {
+		// Daemons that predate protocol versions reply with a
+		// bool.
+		log.Fatalf("reading reply from perflock daemon: %v (the daemon may need to be upgraded)", err)
+	}
+	for resp.Reset {
+		// The daemon is being replaced. Keep waiting on the
+		// new one.
+		c.reset()
+		resp = AcquireResponse{}
+		if err := c.gw.Decode(&resp); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if resp.Err != "" {
+		return false, fmt.Errorf("%s", resp.Err)
+	}
+	c.finalNotice = resp.FinalNotice
+	return resp.Acquired, nil
 }
 
 func (c *Client) List() []string {
@@ -54,11 +139,75 @@ func (c *Client) List() []string {
 	return list
 }
 
-func (c *Client) SetGovernor(percent int) error {
+// EstimateWait returns the estimated time until an acquisition would
+// succeed, or false if this is unknown.
+func (c *Client) EstimateWait(shared bool, msg string) (time.Duration, bool) {
+	var wait time.Duration
+	c.do(PerfLockAction{ActionEstimateWait{Shared: shared, Msg: msg}}, &wait)
+	return wait, wait >= 0
+}
+
+func (c *Client) SetGovernor(req ActionSetGovernor) error {
 	var err string
-	c.do(PerfLockAction{ActionSetGovernor{Percent: percent}}, &err)
+	c.do(PerfLockAction{req}, &err)
 	if err == "" {
 		return nil
 	}
 	return fmt.Errorf("%s", err)
 }
+
+// Watch prints notices from the daemon while the lock is held. This
+// must be called after acquiring the lock and setting the governor.
+func (c *Client) Watch() {
+	c.released = make(chan struct{})
+	go func() {
+		defer close(c.released)
+		sawNotice := false
+		for {
+			var n Notice
+			if err := c.gw.Decode(&n); err != nil {
+				if !sawNotice {
+					log.Print("lost connection to perflock daemon: ", err)
+				}
+				return
+			}
+			if n.Reset {
+				c.reset()
+				continue
+			}
+			if n.Msg != "" {
+				log.Print(n.Msg)
+			}
+			if n.Released {
+				return
+			}
+			sawNotice = true
+		}
+	}()
+}
+
+// Release releases the lock. If the daemon supports it, Release waits
+// for the daemon to report on the run, which the Watch goroutine
+// prints.
+func (c *Client) Release(exited bool, status int) {
+	wait := c.finalNotice && c.released != nil
+	c.send(PerfLockAction{ActionRelease{Exited: exited, ExitStatus: status, Wait: wait}})
+	if wait {
+		select {
+		case <-c.released:
+		case <-time.After(releaseTimeout):
+		}
+	}
+}
+
+func (c *Client) Status() StatusResponse {
+	var st StatusResponse
+	c.do(PerfLockAction{ActionStatus{}}, &st)
+	return st
+}
+
+func (c *Client) History(user string, since time.Time) []HoldRecord {
+	var hist []HoldRecord
+	c.do(PerfLockAction{ActionHistory{User: user, Since: since}}, &hist)
+	return hist
+}
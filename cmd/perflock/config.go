@@ -0,0 +1,469 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for daemon settings.
+const (
+	defaultConfigFile  = "/etc/perflock.conf"
+	defaultSocket      = "/var/run/perflock.socket"
+	defaultSocketMode  = 0777
+	defaultHistoryFile = "/var/lib/perflock/history"
+	defaultStateFile   = "/var/lib/perflock/state.json"
+	defaultGovernor    = 90
+)
+
+// daemonConfig is the configuration of the perflock daemon. It is
+// read from the configuration file and command-line flags. Once
+// loaded, a daemonConfig must not be modified, since it may be shared
+// by many connections.
+//
+// The configuration file consists of lines of the form
+//
+//	key value...
+//
+// Blank lines and lines starting with # are ignored. The keys are:
+//
+//	socket path            UNIX domain socket to listen on
+//	socket-mode mode       permissions of the socket, in octal
+//	history-file path      history log, or "none"
+//	state-file path        saved CPU settings, or "none"
+//	http addr              address to serve the status page on; a bare
+//	                       ":port" listens on localhost only, since the
+//	                       page is unauthenticated and shows commands
+//	governor percent       default CPU governor setting (N% or "none")
+//	turbo on|off|none      default turbo boost setting for exclusive
+//	                       locks ("none", the default, leaves it alone)
+//	cpugov name|none       default kernel scaling governor for exclusive
+//	                       locks ("none", the default, leaves it alone)
+//	max-hold duration      revoke locks held longer than duration
+//	hook event program     run program on event (see hooks.go)
+//	hook-timeout duration  kill hooks that run longer than duration
+//	                       (default 20s)
+//	allow-exclusive principal...
+//	                       only these principals may acquire exclusive locks
+//	allow-tuning principal...
+//	                       only these principals may change CPU settings
+//	shared-only principal...
+//	                       these principals may only acquire shared locks
+//	                       and may not change CPU settings
+//	quota-exclusive limit window
+//	                       limit each user's exclusive hold time to limit
+//	                       over any rolling window (e.g., 4h 24h); may be
+//	                       given more than once
+//	quota-queued n         limit each user to n queued requests
+//	quota-action action    "reject" (default) or "demote" over-quota
+//	                       requests to low priority
+//	max-conns-per-user n   limit each user to n connections to the daemon
+//	                       (default 64; 0 for no limit)
+//	profile name setting...
+//	                       define a named tuning profile (see tuningProfile)
+//
+// Principals are described by accessList. By default, everyone may
+// acquire exclusive locks and change CPU settings. Access control
+// never restricts root.
+//
+// Quotas are charged to the user who logged in, so requests made
+// through sudo count against the user who ran sudo. Quotas don't
+// apply to root otherwise.
+//
+// The daemon re-reads the configuration file on SIGHUP. Changes to
+// socket, socket-mode, history-file, state-file, and http only take
+// effect when the daemon restarts.
+type daemonConfig struct {
+	// socket is the path of the UNIX domain socket to listen on.
+	socket string
+
+	// socketMode is the permissions of socket.
+	socketMode os.FileMode
+
+	// historyFile is the path of the history log, or "" to not
+	// record history.
+	historyFile string
+
+	// stateFile is the path of the file recording CPU settings to
+	// restore after a crash, or "" to not record them.
+	stateFile string
+
+	// httpAddr is the address to serve the status page on, or ""
+	// to not serve it.
+	httpAddr string
+
+	// governor is the default governor setting, as a percent
+	// between the minimum and maximum frequencies, or -1 to not
+	// change the governor by default.
+	governor int
+
+	// turbo is the default turbo boost setting: "on", "off", or
+	// "" to not change turbo boost by default.
+	turbo string
+
+	// cpuGovernor is the default kernel scaling governor, or ""
+	// to not change it by default.
+	cpuGovernor string
+
+	// maxHold is the maximum time a lock may be held before the
+	// daemon revokes it, or 0 for no limit.
+	maxHold time.Duration
+
+	// Hook executables, or "" for none. See hooks.go.
+	hookPreExclusive string
+	hookShared       string
+	hookPostRelease  string
+	// hookTimeout is the maximum time a hook may run.
+	hookTimeout time.Duration
+
+	// profiles are the named tuning profiles clients can request.
+	profiles map[string]*tuningProfile
+
+	// Access control. See policy.go.
+	allowExclusive accessList
+	allowTuning    accessList
+	sharedOnly     accessList
+
+	// Per-user quotas. See quota.go. quotaQueued is 0 for no
+	// limit.
+	quotaExclusive []exclusiveQuota
+	quotaQueued    int
+	quotaDemote    bool
+
+	// maxConnsPerUser limits the number of connections from each
+	// user, other than root, or is 0 for no limit. See limits.go.
+	maxConnsPerUser int
+}
+
+// tuningProfile is a named set of CPU tuning settings. In the
+// configuration file, a profile is defined by a line of the form
+//
+//	profile name key=value...
+//
+// where the keys are:
+//
+//	governor=N%|none       set the CPU frequency as for -governor
+//	turbo=on|off|none      set turbo boost as for -turbo
+//	cpugov=name            set the kernel scaling governor as for -cpugov
+type tuningProfile struct {
+	// governor is the governor percent, or -1 for no change.
+	governor int
+	// turbo is "on", "off", or "" for the daemon's default.
+	turbo string
+	// cpuGovernor is the scaling governor, or "" for the
+	// daemon's default.
+	cpuGovernor string
+}
+
+func defaultConfig() *daemonConfig {
+	return &daemonConfig{
+		socket:      defaultSocket,
+		socketMode:  defaultSocketMode,
+		historyFile: defaultHistoryFile,
+		stateFile:   defaultStateFile,
+		governor:    defaultGovernor,
+		profiles:    map[string]*tuningProfile{},
+		hookTimeout: defaultHookTimeout,
+
+		maxConnsPerUser: defaultMaxConnsPerUser,
+	}
+}
+
+var theConfig atomic.Pointer[daemonConfig]
+
+// currentConfig returns the current daemon configuration.
+func currentConfig() *daemonConfig {
+	return theConfig.Load()
+}
+
+// loadConfig reads the configuration file at path, if it exists, and
+// then applies overrides, which applies command-line flags.
+func loadConfig(path string, overrides func(*daemonConfig)) (*daemonConfig, error) {
+	cfg := defaultConfig()
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		if err := cfg.parse(path, f); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if overrides != nil {
+		overrides(cfg)
+	}
+	return cfg, nil
+}
+
+// parse parses a configuration file from r into cfg.
+func (cfg *daemonConfig) parse(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := cfg.set(fields[0], fields[1:]); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// set sets configuration key to args.
+func (cfg *daemonConfig) set(key string, args []string) error {
+	nargs := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s takes %d argument(s)", key, n)
+		}
+		return nil
+	}
+	path := func(dst *string) error {
+		if err := nargs(1); err != nil {
+			return err
+		}
+		*dst = args[0]
+		if *dst == "none" {
+			*dst = ""
+		}
+		return nil
+	}
+
+	switch key {
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+
+	case "socket":
+		return path(&cfg.socket)
+
+	case "socket-mode":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		mode, err := strconv.ParseUint(args[0], 8, 32)
+		if err != nil || mode&^0777 != 0 {
+			return fmt.Errorf("bad socket-mode %q", args[0])
+		}
+		cfg.socketMode = os.FileMode(mode)
+
+	case "history-file":
+		return path(&cfg.historyFile)
+
+	case "state-file":
+		return path(&cfg.stateFile)
+
+	case "http":
+		return path(&cfg.httpAddr)
+
+	case "governor":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		var f governorFlag
+		if err := f.Set(args[0]); err != nil {
+			return err
+		}
+		cfg.governor = f.percent
+
+	case "turbo":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		t, err := parseTurbo(args[0])
+		if err != nil {
+			return err
+		}
+		cfg.turbo = t
+
+	case "cpugov":
+		if err := path(&cfg.cpuGovernor); err != nil {
+			return err
+		}
+
+	case "max-hold":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad max-hold %q", args[0])
+		}
+		cfg.maxHold = d
+
+	case "hook":
+		if err := nargs(2); err != nil {
+			return err
+		}
+		switch args[0] {
+		case hookPreExclusive:
+			cfg.hookPreExclusive = args[1]
+		case hookShared:
+			cfg.hookShared = args[1]
+		case hookPostRelease:
+			cfg.hookPostRelease = args[1]
+		default:
+			return fmt.Errorf("unknown hook event %q", args[0])
+		}
+
+	case "hook-timeout":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("bad hook-timeout %q", args[0])
+		}
+		cfg.hookTimeout = d
+
+	case "allow-exclusive":
+		cfg.allowExclusive = cfg.allowExclusive.add(args)
+
+	case "allow-tuning":
+		cfg.allowTuning = cfg.allowTuning.add(args)
+
+	case "shared-only":
+		cfg.sharedOnly = cfg.sharedOnly.add(args)
+
+	case "quota-exclusive":
+		if err := nargs(2); err != nil {
+			return err
+		}
+		limit, err1 := time.ParseDuration(args[0])
+		window, err2 := time.ParseDuration(args[1])
+		if err1 != nil || err2 != nil || limit <= 0 || window <= 0 {
+			return fmt.Errorf("bad quota-exclusive %q", strings.Join(args, " "))
+		}
+		cfg.quotaExclusive = append(cfg.quotaExclusive, exclusiveQuota{limit, window})
+
+	case "quota-queued":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad quota-queued %q", args[0])
+		}
+		cfg.quotaQueued = n
+
+	case "max-conns-per-user":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad max-conns-per-user %q", args[0])
+		}
+		cfg.maxConnsPerUser = n
+
+	case "quota-action":
+		if err := nargs(1); err != nil {
+			return err
+		}
+		switch args[0] {
+		case "reject":
+			cfg.quotaDemote = false
+		case "demote":
+			cfg.quotaDemote = true
+		default:
+			return fmt.Errorf("bad quota-action %q", args[0])
+		}
+
+	case "profile":
+		if len(args) < 1 {
+			return fmt.Errorf("profile requires a name")
+		}
+		p, err := parseProfile(args[1:])
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", args[0], err)
+		}
+		cfg.profiles[args[0]] = p
+	}
+	return nil
+}
+
+func parseProfile(settings []string) (*tuningProfile, error) {
+	p := &tuningProfile{governor: -1}
+	for _, setting := range settings {
+		key, val, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("setting %q must be key=value", setting)
+		}
+		switch key {
+		default:
+			return nil, fmt.Errorf("unknown setting %q", key)
+		case "governor":
+			var f governorFlag
+			if err := f.Set(val); err != nil {
+				return nil, err
+			}
+			p.governor = f.percent
+		case "turbo":
+			t, err := parseTurbo(val)
+			if err != nil {
+				return nil, err
+			}
+			p.turbo = t
+		case "cpugov":
+			p.cpuGovernor = val
+		}
+	}
+	return p, nil
+}
+
+// parseTurbo parses a turbo boost setting: "on", "off", or "none" or
+// "" (unset), which it returns as "".
+func parseTurbo(v string) (string, error) {
+	switch v {
+	case "on", "off":
+		return v, nil
+	case "none", "":
+		return "", nil
+	}
+	return "", fmt.Errorf("turbo must be \"on\", \"off\", or \"none\"")
+}
+
+// reloadConfig re-reads the configuration and makes it current.
+func reloadConfig(path string, overrides func(*daemonConfig)) {
+	cfg, err := loadConfig(path, overrides)
+	if err != nil {
+		slog.Error("not reloading configuration", "event", "reload", "err", err)
+		return
+	}
+
+	// Some settings can't be changed without restarting.
+	old := currentConfig()
+	for _, c := range []struct {
+		name     string
+		old, new *string
+	}{
+		{"socket", &old.socket, &cfg.socket},
+		{"history-file", &old.historyFile, &cfg.historyFile},
+		{"state-file", &old.stateFile, &cfg.stateFile},
+		{"http", &old.httpAddr, &cfg.httpAddr},
+	} {
+		if *c.old != *c.new {
+			slog.Warn("changing "+c.name+" requires restarting the daemon", "event", "reload")
+			*c.new = *c.old
+		}
+	}
+	if old.socketMode != cfg.socketMode {
+		slog.Warn("changing socket-mode requires restarting the daemon", "event", "reload")
+		cfg.socketMode = old.socketMode
+	}
+
+	theConfig.Store(cfg)
+	if err := theHistory.SetQuotaWindow(cfg.quotaWindow()); err != nil {
+		slog.Error("reading history for quota", "event", "reload", "err", err)
+	}
+	slog.Info("reloaded configuration", "event", "reload", "path", path)
+}
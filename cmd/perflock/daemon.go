@@ -5,14 +5,21 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
-	"os/user"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/aclements/perflock/internal/cpupower"
@@ -21,186 +28,950 @@ import (
 
 var theLock PerfLock
 
-func doDaemon(path string) {
-	// TODO: Don't start if another daemon is already running.
+func doDaemon(configPath string, overrides func(*daemonConfig)) {
+	cfg, err := loadConfig(configPath, overrides)
+	if err != nil {
+		log.Fatal(err)
+	}
+	theConfig.Store(cfg)
+
+	if cfg.historyFile != "" {
+		h, err := OpenHistory(cfg.historyFile)
+		if err != nil {
+			slog.Error("not recording history", "err", err)
+		} else {
+			theHistory = h
+			if err := h.SetQuotaWindow(cfg.quotaWindow()); err != nil {
+				// Don't lock people out because of a
+				// broken history log.
+				slog.Error("reading history for quota", "err", err)
+			}
+		}
+	}
+
+	var l, hl net.Listener
+	var inherited *inheritedDaemon
+	if fd := os.Getenv(handoffEnv); fd != "" {
+		// Another daemon is handing off to us. See handoff.go.
+		inherited, err = receiveHandoff(fd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, hl = inherited.listener, inherited.http
+		if cfg.stateFile != "" {
+			theState, err = ResumeStateFile(cfg.stateFile, inherited.state.Saved)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		l, err = listen(cfg.socket, cfg.socketMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Now that we know we're the only daemon, restore any
+		// CPU settings left behind by a previous daemon that
+		// crashed.
+		if cfg.stateFile != "" {
+			theState, err = OpenStateFile(cfg.stateFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if cfg.httpAddr != "" {
+			hl, err = net.Listen("tcp", dashboardAddr(cfg.httpAddr))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	defer l.Close()
+	daemonSocket = l.Addr().String()
+	if inherited != nil && !inherited.state.Started.IsZero() {
+		daemonStarted = inherited.state.Started
+	}
+
+	if hl != nil {
+		go serveDashboard(hl)
+	}
+
+	if inherited != nil {
+		if err := inherited.resume(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("notifying systemd", "err", err)
+	}
+	go sdWatchdog()
+	go handleSignals(l, func() { reloadConfig(configPath, overrides) }, func() { upgrade(l, hl) })
+
+	// Receive connections.
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if shuttingDown() {
+				// Let shutdown finish and exit.
+				select {}
+			}
+			if acceptPaused() {
+				continue
+			}
+			log.Fatal(err)
+		}
+		acceptBusy.Store(time.Now().UnixNano())
+		if !startServer(NewServer(conn)) {
+			conn.Close()
+		}
+		acceptBusy.Store(0)
+	}
+}
 
+// listen returns the daemon's listening socket. This is either
+// passed in by systemd socket activation or created at path. It
+// fails if another daemon is already running on path.
+func listen(path string, mode os.FileMode) (net.Listener, error) {
 	// Linux supports an abstract namespace for UNIX domain sockets (see unix(7)).
 	// These do not involve the filesystem, and are world-connectable.
 	isAbstractSocket := runtime.GOOS == "linux" && len(path) > 1 && path[0] == '@'
 	if !isAbstractSocket {
+		// Binding an abstract socket fails if it's already
+		// in use, but for filesystem sockets we have to
+		// check for another daemon ourselves.
+		if err := lockPIDFile(path + ".pid"); err != nil {
+			return nil, err
+		}
+	}
+
+	if l, err := systemdListener(); l != nil || err != nil {
+		return l, err
+	}
+
+	if !isAbstractSocket {
+		// The PID file lock should keep out other daemons,
+		// but a daemon from before we had PID files may
+		// still be listening. Make sure nothing answers on
+		// the socket before removing it.
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("another perflock daemon is already listening on %s", path)
+		}
 		os.Remove(path)
 	}
 	l, err := net.Listen("unix", path)
 	if err != nil {
-		log.Fatal(err)
+		if isAbstractSocket && errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("another perflock daemon is already listening on %s", path)
+		}
+		return nil, err
 	}
-	defer l.Close()
 	if !isAbstractSocket {
-		err = os.Chmod(path, 0777)
+		err = os.Chmod(path, mode)
 		if err != nil {
-			log.Fatal(err)
+			l.Close()
+			return nil, err
 		}
 	}
+	return l, nil
+}
 
-	// Receive connections.
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal(err)
-		}
+// pidFile is the daemon's locked PID file. It is held open for the
+// life of the daemon to keep the lock.
+var pidFile *os.File
 
-		go func(c net.Conn) {
-			defer c.Close()
-			NewServer(c).Serve()
-		}(conn)
+// lockPIDFile acquires an exclusive lock on the PID file at path and
+// records this process's PID in it. It fails if another process holds
+// the lock.
+func lockPIDFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if err == syscall.EWOULDBLOCK {
+			pid, _ := io.ReadAll(f)
+			return fmt.Errorf("another perflock daemon (pid %s) is already running (%s is locked)", strings.TrimSpace(string(pid)), path)
+		}
+		return fmt.Errorf("locking %s: %w", path, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
 	}
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		return err
+	}
+	pidFile = f
+	return nil
 }
 
+// holderCheckInterval is how often the daemon checks that the client
+// processes holding or waiting for the lock are still running.
+const holderCheckInterval = 10 * time.Second
+
+// nextConnID is the ID of the next client connection.
+var nextConnID atomic.Uint64
+
 type Server struct {
 	c        net.Conn
+	id       uint64
 	userName string
+	ident    *identity
+
+	// realUser is the user who originally logged in, if different
+	// from userName, such as when the client runs under sudo.
+	realUser string
+
+	// log is the logger for this connection. Its records carry the
+	// connection ID and, once known, the client's credentials.
+	log *slog.Logger
+	// req is the ID of the current request on this connection.
+	req uint64
+
+	// pid and cgroup identify the client process, and proc is a
+	// handle to it for detecting when it exits. proc is nil if the
+	// client's PID is unknown.
+	pid    int
+	cgroup string
+	proc   *process
 
 	locker    *Locker
 	acquiring bool
 
+	// version is the client's protocolVersion.
+	version int
+
+	// acquireC receives when the lock is granted, and retryC fires
+	// when a delayed pre-grant hook should be retried.
+	acquireC <-chan bool
+	retryC   <-chan time.Time
+
+	// hookC receives the result of the running pre-grant hook, and
+	// cancelHook kills it. See grant.
+	hookC      <-chan error
+	cancelHook context.CancelFunc
+
+	// hold records the current hold for the history log.
+	hold HoldRecord
+
+	// oldGovernors, oldTurbo, and oldPState are the original CPU
+	// settings, saved before tuning them. oldGovernors is non-nil
+	// once the settings have been saved. oldPState is nil if the
+	// host's P-state driver has no global performance limits.
 	oldGovernors []*governorSettings
+	oldTurbo     []*turboSettings
+	oldPState    *pstateSettings
+
+	// freq samples the frequency of the domains pinned by
+	// setGovernor, or is nil.
+	freq *freqMonitor
+
+	// thermal is the thermal state of the host when the lock was
+	// granted, or nil.
+	thermal *thermalSnapshot
+
+	// lease fires when the lock has been held for the configured
+	// max-hold time.
+	lease <-chan time.Time
+
+	// handoff indicates that the client supports being handed off
+	// to a new daemon, and watching indicates that such a client
+	// has finished making requests and is only reading Notices.
+	// See handoff.go.
+	handoff  bool
+	watching bool
+
+	// quiesced receives when the connection has been reset for a
+	// handoff, after which the Server waits on resume to learn
+	// whether the handoff succeeded. handedOff is set if it did.
+	quiesced  chan struct{}
+	resume    chan bool
+	handedOff bool
+
+	// stop is closed by stopServing when the daemon is shutting
+	// down.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// done is closed when Serve returns.
+	done chan struct{}
 }
 
 func NewServer(c net.Conn) *Server {
-	return &Server{c: c}
+	return newServer(c, nextConnID.Add(1))
 }
 
-func (s *Server) Serve() {
-	// Drop any held locks if we exit for any reason.
-	defer s.drop()
+func newServer(c net.Conn, id uint64) *Server {
+	return &Server{
+		c:        c,
+		id:       id,
+		log:      slog.With("conn", id),
+		quiesced: make(chan struct{}, 1),
+		resume:   make(chan bool, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
 
-	// Get connection credentials.
-	cred, err := peercred.Get(s.c)
-	if err != nil {
-		log.Print("reading credentials: ", err)
-		return
+// stopServing asks s to release its lock and stop serving because
+// the daemon is shutting down.
+func (s *Server) stopServing() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// logEvent logs an event on this connection, attributed to the
+// current request.
+func (s *Server) logEvent(level slog.Level, event, msg string, args ...any) {
+	args = append([]any{"event", event, "req", s.req}, args...)
+	s.log.Log(context.Background(), level, msg, args...)
+}
+
+// reply sends v to the client. It returns false if this failed, in
+// which case the connection is unusable.
+func (s *Server) reply(gw *gob.Encoder, v interface{}) bool {
+	if err := s.write(gw, v); err != nil {
+		s.logEvent(slog.LevelWarn, "write-error", "writing response", "err", err)
+		return false
 	}
+	return true
+}
+
+// write sends v to the client, giving up if the client doesn't
+// accept it within writeTimeout.
+func (s *Server) write(gw *gob.Encoder, v interface{}) error {
+	s.c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	defer s.c.SetWriteDeadline(time.Time{})
+	return gw.Encode(v)
+}
 
-	s.userName = "???"
-	if uid, ok := cred.UserID(); ok {
-		if u, err := user.LookupId(uid); err == nil {
-			s.userName = u.Username
+// refuse refuses the client's connection because of msg. If the
+// client's first request is to acquire the lock, it tells the client
+// why.
+func (s *Server) refuse(actions <-chan PerfLockAction, gw *gob.Encoder, msg string) {
+	s.logEvent(slog.LevelWarn, "conn-limit", msg)
+	if action, ok := <-actions; ok {
+		if action, ok := action.Action.(ActionAcquire); ok {
+			s.version = action.Version
+			s.replyAcquire(gw, AcquireResponse{Err: msg})
 		}
 	}
+}
 
-	// Receive incoming actions. We do this in a goroutine so the
-	// main handler can select on EOF or lock acquisition.
-	actions := make(chan PerfLockAction)
-	go func() {
-		gr := gob.NewDecoder(s.c)
-		for {
-			var msg PerfLockAction
-			err := gr.Decode(&msg)
-			if err != nil {
-				if err != io.EOF {
-					log.Print(err)
-				}
-				close(actions)
-				return
-			}
-			actions <- msg
+// replyAcquire sends resp in reply to ActionAcquire, in the form the
+// client's protocol version expects. It returns false if this failed,
+// in which case the connection is unusable.
+func (s *Server) replyAcquire(gw *gob.Encoder, resp AcquireResponse) bool {
+	if err := s.writeAcquire(gw, resp); err != nil {
+		s.logEvent(slog.LevelWarn, "write-error", "writing response", "err", err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) writeAcquire(gw *gob.Encoder, resp AcquireResponse) error {
+	if s.version >= 1 {
+		return s.write(gw, resp)
+	}
+	if resp.Err != "" {
+		// Version 0 clients would take false to mean they
+		// should wait for the lock, so close the connection.
+		return fmt.Errorf("can't send error to version 0 client: %s", resp.Err)
+	}
+	return s.write(gw, resp.Acquired)
+}
+
+// notice sends n to the client if it reads Notices. It returns false
+// if this failed, in which case the connection is unusable.
+func (s *Server) notice(gw *gob.Encoder, n Notice) bool {
+	if s.version < 1 {
+		return true
+	}
+	return s.reply(gw, n)
+}
+
+// answerTune answers a client that was granted the lock but has not
+// yet asked to tune the CPU. Such a client reads the reply to its
+// ActionSetGovernor before any Notice, so it fails that request with
+// msg.
+func (s *Server) answerTune(actions <-chan PerfLockAction, gw *gob.Encoder, msg string) {
+	select {
+	case action, ok := <-actions:
+		if _, isTune := action.Action.(ActionSetGovernor); ok && isTune {
+			s.reply(gw, msg)
+		}
+	case <-time.After(messageTimeout):
+	}
+}
+
+func (s *Server) Serve() {
+	defer func() {
+		s.proc.close()
+		// Drop any held locks if we exit for any reason,
+		// unless another daemon took over the connection.
+		if s.handedOff {
+			// The new daemon runs any pre-grant hook
+			// again.
+			s.stopHook()
+			s.logEvent(slog.LevelDebug, "handoff", "connection handed off")
+			return
 		}
+		s.drop()
+		s.logEvent(slog.LevelDebug, "disconnect", "client disconnected")
 	}()
 
+	// Connections resumed from a handoff have already been
+	// identified.
+	newConn := s.ident == nil
+	if newConn {
+		if !s.identify() {
+			return
+		}
+		s.logEvent(slog.LevelDebug, "connect", "client connected", "cgroup", s.cgroup)
+		s.c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	}
+	nconns := addConn(s.ident.uid)
+	defer dropConn(s.ident.uid)
+
 	// Process incoming actions.
-	var acquireC <-chan bool
+	actions := s.receive()
 	gw := gob.NewEncoder(s.c)
+	if limit := currentConfig().maxConnsPerUser; newConn && limit > 0 && nconns > limit && !s.ident.isRoot() {
+		s.refuse(actions, gw, fmt.Sprintf("user %s has too many connections to the perflock daemon (limit %d)", s.userName, limit))
+		return
+	}
+	var checkC <-chan time.Time
+	if s.proc != nil {
+		ticker := time.NewTicker(holderCheckInterval)
+		defer ticker.Stop()
+		checkC = ticker.C
+	}
+	handoffC := handoffRequested()
+	quiescing, reset := false, false
 	for {
+		if quiescing && !reset && (s.acquiring && s.handoff || s.watching) {
+			// The client is waiting for a response we
+			// know the type of, so it can recognize a
+			// Reset.
+			var ok bool
+			if s.acquiring {
+				ok = s.replyAcquire(gw, AcquireResponse{Reset: true})
+			} else {
+				ok = s.reply(gw, Notice{Reset: true})
+			}
+			if !ok {
+				return
+			}
+			reset = true
+		}
+		// Once we've sent a Reset, we can't send anything
+		// else, so leave any lock events for whoever takes
+		// over the connection.
+		acquireC, retryC, hookC, lease, checkC := s.acquireC, s.retryC, s.hookC, s.lease, checkC
+		if reset {
+			acquireC, retryC, hookC, lease, checkC = nil, nil, nil, nil, nil
+		}
+
 		select {
+		case <-handoffC:
+			// Another daemon is taking over. Wait until
+			// the client is at a point where we can
+			// reset its connection.
+			handoffC = nil
+			quiescing = true
+
 		case action, ok := <-actions:
 			if !ok {
 				// Connection closed.
 				return
 			}
+			if _, ok := action.Action.(ActionReset); ok {
+				if !reset {
+					s.logEvent(slog.LevelWarn, "protocol-error", "unexpected reset")
+					return
+				}
+				s.quiesced <- struct{}{}
+				if <-s.resume {
+					s.handedOff = true
+					return
+				}
+				// The handoff failed. Carry on with the
+				// client's new streams ourselves.
+				s.logEvent(slog.LevelInfo, "handoff", "resuming connection after failed handoff")
+				actions = s.receive()
+				gw = gob.NewEncoder(s.c)
+				handoffC = handoffRequested()
+				quiescing, reset = false, false
+				break
+			}
+			s.req++
 			if s.acquiring {
-				log.Printf("protocol error: message while acquiring")
+				s.logEvent(slog.LevelWarn, "protocol-error", "message while acquiring")
 				return
 			}
 			switch action := action.Action.(type) {
 			case ActionAcquire:
 				if s.locker != nil {
-					log.Printf("protocol error: acquiring lock twice")
+					s.logEvent(slog.LevelWarn, "protocol-error", "acquiring lock twice")
 					return
 				}
-				msg := fmt.Sprintf("%s\t%s\t%s", s.userName, time.Now().Format(time.Stamp), action.Msg)
-				if action.Shared {
-					msg += " [shared]"
+				s.version = action.Version
+				if !action.Shared && !currentConfig().mayAcquireExclusive(s.ident) {
+					s.logEvent(slog.LevelInfo, "deny", "exclusive lock not permitted", "cmd", action.Msg)
+					resp := AcquireResponse{Err: fmt.Sprintf("user %s is not permitted to acquire the lock in exclusive mode; use -shared", s.userName)}
+					if !s.replyAcquire(gw, resp) {
+						return
+					}
+					break
+				}
+				now := time.Now()
+				demote, err := currentConfig().checkQuota(s.ident, s.realUser, action.Shared, theLock.Queue(), now)
+				if err != nil {
+					s.logEvent(slog.LevelInfo, "deny", "over quota", "cmd", action.Msg, "err", err)
+					if !s.replyAcquire(gw, AcquireResponse{Err: err.Error()}) {
+						return
+					}
+					break
 				}
-				s.locker = theLock.Enqueue(action.Shared, action.NonBlocking, msg)
+				s.hold = HoldRecord{User: s.userName, RealUser: s.realUser, Msg: action.Msg, Shared: action.Shared, Demoted: demote, PID: s.pid, Cgroup: s.cgroup, Enqueued: now}
+				s.handoff, s.watching = action.Handoff, false
+				s.locker = theLock.Enqueue(s.hold, action.NonBlocking)
 				if s.locker != nil {
 					// Enqueued. Wait for acquire.
+					s.logEvent(slog.LevelInfo, "enqueue", "waiting for lock", "cmd", action.Msg, "mode", s.hold.Mode(), "demoted", demote)
 					s.acquiring = true
-					acquireC = s.locker.C
+					s.acquireC = s.locker.C
 				} else {
 					// Non-blocking acquire failed.
-					if err := gw.Encode(false); err != nil {
-						log.Print(err)
+					s.hold = HoldRecord{}
+					if !s.replyAcquire(gw, AcquireResponse{}) {
 						return
 					}
 				}
 
 			case ActionList:
-				list := theLock.Queue()
-				if err := gw.Encode(list); err != nil {
-					log.Print(err)
+				list := formatQueue(theLock.Queue(), time.Now())
+				if !s.reply(gw, list) {
+					return
+				}
+
+			case ActionEstimateWait:
+				hold := HoldRecord{User: s.userName, Msg: action.Msg, Shared: action.Shared}
+				wait, ok := estimateWait(theLock.Queue(), hold, time.Now())
+				if !ok {
+					wait = -1
+				}
+				if !s.reply(gw, wait) {
 					return
 				}
 
 			case ActionSetGovernor:
 				if s.locker == nil {
-					log.Printf("protocol error: setting governor without lock")
+					s.logEvent(slog.LevelWarn, "protocol-error", "setting governor without lock")
 					return
 				}
-				err := s.setGovernor(action.Percent)
+				err := s.tune(action)
 				errString := ""
 				if err != nil {
+					s.logEvent(slog.LevelWarn, "tune", "changing CPU settings", "err", err)
 					errString = err.Error()
 				}
-				if err := gw.Encode(errString); err != nil {
-					log.Print(err)
+				if !s.reply(gw, errString) {
+					return
+				}
+				// The client will now only read Notices.
+				s.watching = s.handoff
+
+			case ActionRelease:
+				// Reply before dropping the lock, so the
+				// client doesn't wait for the settings to be
+				// restored and the post-release hook to run.
+				report := s.stopFreqMonitor()
+				if warning := s.checkThermal(); warning != "" {
+					report = strings.TrimPrefix(report+"\n"+warning, "\n")
+				}
+				if action.Wait {
+					s.reply(gw, Notice{Msg: report, Released: true})
+				}
+				if s.locker == nil {
+					// The daemon may have already revoked
+					// the lock.
+					break
+				}
+				s.hold.Exited, s.hold.ExitStatus = action.Exited, action.ExitStatus
+				s.drop()
+
+			case ActionStatus:
+				if !s.reply(gw, s.status()) {
+					return
+				}
+
+			case ActionHistory:
+				hist, err := theHistory.Query(action.User, action.Since)
+				if err != nil {
+					s.logEvent(slog.LevelError, "history", "reading history", "err", err)
+				}
+				if !s.reply(gw, hist) {
 					return
 				}
 
 			default:
-				log.Printf("unknown message")
+				s.logEvent(slog.LevelWarn, "protocol-error", "unknown message", "type", fmt.Sprintf("%T", action))
 				return
 			}
 
 		case <-acquireC:
-			// Lock acquired.
-			s.acquiring, acquireC = false, nil
-			if err := gw.Encode(true); err != nil {
-				log.Print(err)
+			// Lock acquired. Run any pre-grant hook before
+			// telling the client.
+			s.acquireC = nil
+			s.grant()
+
+		case <-retryC:
+			// The pre-grant hook asked us to try again.
+			s.grant()
+
+		case err := <-hookC:
+			s.stopHook()
+			if err := s.finishGrant(gw, err); err != nil {
+				s.logEvent(slog.LevelWarn, "write-error", "writing response", "err", err)
+				return
+			}
+
+		case <-lease:
+			// The lock has been held too long. Revoke it.
+			held := time.Since(s.hold.Acquired).Round(time.Second)
+			s.logEvent(slog.LevelWarn, "revoke", "revoking lock held past max-hold", "held", held)
+			s.drop()
+			msg := fmt.Sprintf("lock revoked after being held for %s; CPU settings restored", held)
+			if !s.notice(gw, Notice{Msg: msg}) {
+				return
+			}
+
+		case <-checkC:
+			// Make sure the client process is still around.
+			// If it died but its socket was inherited by
+			// another process, that process could otherwise
+			// hold the lock indefinitely.
+			if s.locker == nil || s.proc.alive() {
+				break
+			}
+			s.logEvent(slog.LevelWarn, "dead-holder", "client process exited; revoking lock", "cmd", s.hold.Msg)
+			acquiring := s.acquiring
+			s.drop()
+			msg := fmt.Sprintf("perflock client process %d exited; lock released and CPU settings restored", s.pid)
+			if acquiring {
+				s.replyAcquire(gw, AcquireResponse{Err: msg})
+			} else {
+				s.notice(gw, Notice{Msg: msg})
+			}
+			return
+
+		case <-s.stop:
+			// The daemon is shutting down. Restore the CPU
+			// settings and release the lock before telling
+			// the client.
+			acquiring, held := s.acquiring, s.locker != nil
+			s.drop()
+			const msg = "perflock daemon is shutting down"
+			if acquiring {
+				s.replyAcquire(gw, AcquireResponse{Err: msg})
+			} else if held {
+				if s.handoff && !s.watching {
+					s.answerTune(actions, gw, msg)
+				}
+				s.notice(gw, Notice{Msg: msg + "; lock released and CPU settings restored"})
+			}
+			return
+		}
+	}
+}
+
+// identify looks up the identity of the client from the
+// connection's credentials. It returns false if this fails.
+func (s *Server) identify() bool {
+	cred, err := peercred.Get(s.c)
+	if err != nil {
+		s.logEvent(slog.LevelWarn, "auth-error", "reading credentials", "err", err)
+		return false
+	}
+
+	uid, ok := cred.UserID()
+	if !ok {
+		s.logEvent(slog.LevelWarn, "auth-error", "reading credentials: no user ID")
+		return false
+	}
+	pid, _ := cred.PID()
+	realUser := ""
+	if pid != 0 {
+		if realUID := procRealUID(pid, uid); realUID != "" && realUID != uid {
+			realUser = lookupIdentity(realUID).user
+		}
+	}
+	s.setClient(uid, pid, realUser)
+	return true
+}
+
+// setClient records that the client is user uid running as process
+// pid, or 0 if the PID is unknown. realUser is the user who
+// originally logged in, if different.
+func (s *Server) setClient(uid string, pid int, realUser string) {
+	s.ident = lookupIdentity(uid)
+	s.userName = s.ident.user
+	s.realUser = realUser
+	s.log = s.log.With("uid", uid, "user", s.userName, "real_user", realUser, "pid", pid)
+	if pid == 0 {
+		return
+	}
+	s.pid = pid
+	s.cgroup = procCgroup(pid)
+	var err error
+	s.proc, err = openProcess(pid)
+	if err != nil {
+		s.log.Warn("watching client process", "event", "auth-error", "pid", pid, "err", err)
+	}
+}
+
+// receive starts a goroutine that decodes a new stream of actions
+// from the client. We do this in a goroutine so the main handler can
+// select on EOF or lock acquisition. The goroutine stops after
+// ActionReset, which ends the stream.
+func (s *Server) receive() <-chan PerfLockAction {
+	actions := make(chan PerfLockAction)
+	go func() {
+		r := &messageReader{r: s.c, c: s.c}
+		gr := gob.NewDecoder(r)
+		for {
+			msg, err := readAction(gr, r)
+			if err != nil {
+				// The connection is closed under us
+				// when the daemon shuts down.
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					s.log.Warn("decoding message", "event", "protocol-error", "err", err)
+				}
+				close(actions)
+				return
+			}
+			select {
+			case actions <- msg:
+			case <-s.done:
+				return
+			}
+			if _, ok := msg.Action.(ActionReset); ok {
 				return
 			}
 		}
+	}()
+	return actions
+}
+
+// grant starts the pre-grant hook for the lock s is acquiring. The
+// hook runs in the background so the connection keeps serving, and
+// s.hookC receives its result, which Serve passes to finishGrant.
+func (s *Server) grant() {
+	s.retryC = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	s.hookC = startHook(ctx, s.log, currentConfig(), s.preGrantHook(), s.hold)
+	s.cancelHook = cancel
+}
+
+// preGrantHook returns the hook event to run before granting s.hold.
+func (s *Server) preGrantHook() string {
+	if s.hold.Shared {
+		return hookShared
 	}
+	return hookPreExclusive
+}
+
+// stopHook kills the running pre-grant hook, if any.
+func (s *Server) stopHook() {
+	if s.cancelHook != nil {
+		s.cancelHook()
+	}
+	s.hookC, s.cancelHook = nil, nil
+}
+
+// finishGrant handles the result of the pre-grant hook. If the hook
+// succeeded, it tells the client it has acquired the lock. If the hook
+// vetoed the grant, it releases the lock and tells the client why. If
+// the hook asked to delay the grant, it sets s.retryC to retry later.
+func (s *Server) finishGrant(gw *gob.Encoder, err error) error {
+	event := s.preGrantHook()
+	cfg := currentConfig()
+	var resp AcquireResponse
+	switch err {
+	case nil:
+		s.acquiring = false
+		s.hold.Acquired = time.Now()
+		resp.Acquired, resp.FinalNotice = true, true
+		var err error
+		if s.thermal, err = takeThermalSnapshot(); err != nil {
+			s.logEvent(slog.LevelWarn, "thermal", "reading thermal state", "err", err)
+		}
+		if cfg.maxHold > 0 {
+			s.lease = time.After(cfg.maxHold)
+		}
+		// Shared clients don't set the governor, so they will
+		// now only read Notices.
+		s.watching = s.handoff && s.hold.Shared
+		s.logEvent(slog.LevelInfo, "acquire", "lock acquired", "cmd", s.hold.Msg, "mode", s.hold.Mode(), "waited", s.hold.Acquired.Sub(s.hold.Enqueued).Round(time.Millisecond))
+	case errHookDelay:
+		s.logEvent(slog.LevelInfo, "hook", "hook delayed grant", "hook", event, "retry", hookRetryDelay)
+		s.retryC = time.After(hookRetryDelay)
+		return nil
+	default:
+		s.logEvent(slog.LevelWarn, "hook", "hook vetoed grant", "hook", event, "err", err)
+		s.acquiring = false
+		s.drop()
+		resp.Err = fmt.Sprintf("lock acquisition vetoed by %s hook", event)
+	}
+	return s.writeAcquire(gw, resp)
 }
 
 func (s *Server) drop() {
+	s.stopHook()
+	s.stopFreqMonitor()
+	s.checkThermal()
 	// Restore the CPU governor before releasing the lock.
-	if s.oldGovernors != nil {
-		s.restoreGovernor()
-		s.oldGovernors = nil
+	if s.oldGovernors != nil || s.oldTurbo != nil || s.oldPState != nil {
+		if err := s.restoreGovernor(); err != nil {
+			s.logEvent(slog.LevelError, "restore", "restoring CPU settings", "err", err)
+		} else if err := theState.Clear(s.id); err != nil {
+			s.logEvent(slog.LevelError, "restore", "clearing saved CPU settings", "err", err)
+		}
+		s.oldGovernors, s.oldTurbo, s.oldPState = nil, nil, nil
+	}
+	// Record completed holds and run the post-release hook. The
+	// hook runs in the background and releases the lock when it
+	// finishes, so it completes before the next holder's pre-grant
+	// hook runs without holding up this connection.
+	locker, post := s.locker, false
+	if !s.hold.Acquired.IsZero() {
+		s.hold.Released = time.Now()
+		s.logEvent(slog.LevelInfo, "release", "lock released", "cmd", s.hold.Msg, "held", s.hold.Released.Sub(s.hold.Acquired).Round(time.Millisecond))
+		if err := theHistory.Append(&s.hold); err != nil {
+			s.logEvent(slog.LevelError, "history", "writing history", "err", err)
+		}
+		if cfg := currentConfig(); cfg.hookPostRelease != "" {
+			post = true
+			pendingHooks.Add(1)
+			result := startHook(context.Background(), s.log, cfg, hookPostRelease, s.hold)
+			go func() {
+				defer pendingHooks.Done()
+				if err := <-result; err != nil {
+					s.log.Warn("post-release hook failed", "event", "hook", "hook", hookPostRelease, "err", err)
+				}
+				if locker != nil {
+					theLock.Dequeue(locker)
+				}
+			}()
+		}
 	}
+	s.hold = HoldRecord{}
+	s.lease = nil
+	s.acquireC, s.retryC = nil, nil
 	// Release the lock.
-	if s.locker != nil {
-		theLock.Dequeue(s.locker)
-		s.locker = nil
+	if locker != nil && !post {
+		theLock.Dequeue(locker)
 	}
+	s.locker = nil
 }
 
-type governorSettings struct {
-	domain   *cpupower.Domain
-	min, max int
+// tune applies the CPU tuning requested by action.
+func (s *Server) tune(action ActionSetGovernor) error {
+	if !action.Default && action.Profile == "" && action.Percent < 0 && action.Turbo == "" && action.CPUGovernor == "" {
+		// The client asked for no change.
+		return nil
+	}
+	cfg := currentConfig()
+	if s.hold.Shared || !cfg.mayTune(s.ident) {
+		if action.Default {
+			// The user didn't ask for anything specific, so
+			// just leave the CPU settings alone.
+			return nil
+		}
+		if s.hold.Shared {
+			// Other shared holders are running under the
+			// current settings, too.
+			return errors.New("CPU settings can't be changed while holding a shared lock")
+		}
+		return fmt.Errorf("user %s is not permitted to change CPU settings", s.userName)
+	}
+	percent, turbo, cpuGov := action.Percent, action.Turbo, action.CPUGovernor
+	switch {
+	case action.Profile != "":
+		p := cfg.profiles[action.Profile]
+		if p == nil {
+			return fmt.Errorf("unknown tuning profile %q", action.Profile)
+		}
+		percent = p.governor
+		if turbo == "" {
+			turbo = p.turbo
+		}
+		if cpuGov == "" {
+			cpuGov = p.cpuGovernor
+		}
+	case action.Default:
+		percent = cfg.governor
+	}
+	if turbo == "" {
+		turbo = cfg.turbo
+	}
+	if cpuGov == "" {
+		cpuGov = cfg.cpuGovernor
+	}
+	if percent < 0 && turbo == "" && cpuGov == "" {
+		return nil
+	}
+
+	// Check the scaling governor is available before changing
+	// anything.
+	if cpuGov != "" {
+		if err := checkCPUGovernor(cpuGov); err != nil {
+			return err
+		}
+	}
+
+	if err := s.saveTuning(); err != nil {
+		return err
+	}
+	defer func() {
+		if s.locker != nil {
+			theLock.SetTuning(s.locker, s.hold)
+		}
+	}()
+	// Changing the P-state mode resets every other setting, so
+	// do it first.
+	if percent >= 0 {
+		s.setPStateMode()
+	}
+	// Set turbo boost and the scaling governor first, since they
+	// may change the frequency range.
+	if turbo != "" {
+		if err := s.setTurbo(turbo == "on"); err != nil {
+			return err
+		}
+		s.hold.Turbo = turbo
+	}
+	if cpuGov != "" {
+		for _, g := range s.oldGovernors {
+			if err := g.domain.SetGovernor(cpuGov); err != nil {
+				return err
+			}
+		}
+		s.hold.CPUGovernor = cpuGov
+	}
+	if percent < 0 {
+		return nil
+	}
+	return s.setGovernor(percent)
 }
 
-func (s *Server) setGovernor(percent int) error {
+// checkCPUGovernor returns an error if any frequency domain can't use
+// scaling governor name.
+func checkCPUGovernor(name string) error {
 	domains, err := cpupower.Domains()
 	if err != nil {
 		return err
@@ -208,17 +979,216 @@ func (s *Server) setGovernor(percent int) error {
 	if len(domains) == 0 {
 		return fmt.Errorf("no power domains")
 	}
+	for _, d := range domains {
+		avail, err := d.AvailableGovernors()
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(avail, name) {
+			return fmt.Errorf("scaling governor %q is not available on %s (available: %s)", name, d.Name(), strings.Join(avail, ", "))
+		}
+	}
+	return nil
+}
+
+// governorSettings are the frequency settings of one domain.
+type governorSettings struct {
+	domain   *cpupower.Domain
+	min, max int
+
+	// governor is the scaling governor, or "" if unknown, and
+	// speed is the frequency set for the userspace governor.
+	governor string
+	speed    int
+
+	// epp is the energy performance preference, or "" if the
+	// domain has none.
+	epp string
+}
+
+// saved returns g in the form recorded by a StateFile.
+func (g *governorSettings) saved() savedRange {
+	return savedRange{g.domain.Path(), g.min, g.max, g.governor, g.speed, g.epp}
+}
+
+// restore applies the settings g to its domain.
+func (g *governorSettings) restore() error {
+	if g.governor != "" {
+		if err := g.domain.SetGovernor(g.governor); err != nil {
+			return err
+		}
+	}
+	if err := g.domain.SetRange(g.min, g.max); err != nil {
+		return err
+	}
+	if g.governor == "userspace" && g.speed != 0 {
+		if err := g.domain.SetSpeed(g.speed); err != nil {
+			return err
+		}
+	}
+	// The driver only accepts some preferences under some
+	// governors, so set this after the governor.
+	if g.epp != "" {
+		return g.domain.SetEPP(g.epp)
+	}
+	return nil
+}
+
+// pstateSettings are the global settings of a P-state driver.
+type pstateSettings struct {
+	pstate *cpupower.PState
+	// min and max are the global performance limits, if the
+	// driver has them.
+	min, max int
+	// status is the driver's operation mode, or "" if unknown.
+	status string
+}
 
-	// Save current frequency settings.
+// saved returns p in the form recorded by a StateFile, or nil if p
+// is nil.
+func (p *pstateSettings) saved() *savedPerfPct {
+	if p == nil {
+		return nil
+	}
+	return &savedPerfPct{p.pstate.Path(), p.min, p.max, p.status}
+}
+
+// restore applies the settings p. Changing the driver's mode resets
+// the settings of every domain, so restore these before the domains.
+func (p *pstateSettings) restore() error {
+	if p.status != "" {
+		if status, err := p.pstate.Status(); err != nil || status != p.status {
+			if err := p.pstate.SetStatus(p.status); err != nil {
+				return err
+			}
+		}
+	}
+	if !p.pstate.HasPerfPct() {
+		return nil
+	}
+	return p.pstate.SetPerfPct(p.min, p.max)
+}
+
+type turboSettings struct {
+	turbo   *cpupower.Turbo
+	enabled bool
+}
+
+// saveTuning saves the current CPU settings so drop can restore them,
+// unless we already saved the original settings.
+func (s *Server) saveTuning() error {
+	if s.oldGovernors != nil {
+		return nil
+	}
+	domains, err := cpupower.Domains()
+	if err != nil {
+		return err
+	}
+	turbos, err := cpupower.TurboControls()
+	if err != nil {
+		return err
+	}
+	pstate, err := cpupower.FindPState()
+	if err != nil {
+		return err
+	}
 	old := []*governorSettings{}
 	for _, d := range domains {
-		min, max, err := d.CurrentRange()
+		g := &governorSettings{domain: d}
+		if g.min, g.max, err = d.CurrentRange(); err != nil {
+			return err
+		}
+		if g.governor, err = d.Governor(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if g.governor == "userspace" {
+			if g.speed, err = d.Speed(); err != nil {
+				return err
+			}
+		}
+		if g.epp, err = d.EPP(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		old = append(old, g)
+	}
+	var oldTurbo []*turboSettings
+	for _, t := range turbos {
+		enabled, err := t.Enabled()
 		if err != nil {
 			return err
 		}
-		old = append(old, &governorSettings{d, min, max})
+		oldTurbo = append(oldTurbo, &turboSettings{t, enabled})
+	}
+	var oldPState *pstateSettings
+	if pstate != nil {
+		oldPState = &pstateSettings{pstate: pstate}
+		if oldPState.status, err = pstate.Status(); err != nil {
+			return err
+		}
+		if pstate.HasPerfPct() {
+			if oldPState.min, oldPState.max, err = pstate.PerfPct(); err != nil {
+				return err
+			}
+		}
+	}
+	// Persist them in case we crash.
+	if err := theState.Save(s.id, old, oldTurbo, oldPState); err != nil {
+		return fmt.Errorf("saving CPU settings: %w", err)
+	}
+	s.oldGovernors, s.oldTurbo, s.oldPState = old, oldTurbo, oldPState
+	return nil
+}
+
+func (s *Server) setTurbo(enabled bool) error {
+	if len(s.oldTurbo) == 0 {
+		return fmt.Errorf("no turbo boost controls")
+	}
+	for _, t := range s.oldTurbo {
+		if err := t.turbo.SetEnabled(enabled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPStateMode switches amd-pstate from passive to guided mode
+// before pinning the frequency. In passive mode, the driver passes
+// the cpufreq governor's choice to the firmware only as a desired
+// performance hint. In guided mode, the firmware itself keeps the
+// frequency within each domain's range. restoreGovernor switches
+// back.
+func (s *Server) setPStateMode() {
+	p := s.oldPState
+	if p == nil || p.pstate.Name() != "amd_pstate" || p.status != "passive" {
+		return
+	}
+	if err := p.pstate.SetStatus("guided"); err != nil {
+		// Kernels before 6.4 don't have guided mode.
+		// Pinning the range still mostly works in passive
+		// mode.
+		s.logEvent(slog.LevelWarn, "tune", "switching amd-pstate to guided mode", "err", err)
+	}
+}
+
+func (s *Server) setGovernor(percent int) error {
+	// Read the domains again, since changing turbo boost may
+	// have changed their available ranges.
+	domains, err := cpupower.Domains()
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		return fmt.Errorf("no power domains")
+	}
+	// intel_pstate's global performance limits apply on top of
+	// each domain's range, so open them up to let the range we set
+	// take effect. The driver clamps these to what the hardware
+	// supports.
+	if s.oldPState != nil && s.oldPState.pstate.HasPerfPct() {
+		if err := s.oldPState.pstate.SetPerfPct(0, 100); err != nil {
+			return err
+		}
 	}
-	s.oldGovernors = old
 
 	// Set new settings.
 	abs := func(x int) int {
@@ -227,6 +1197,7 @@ func (s *Server) setGovernor(percent int) error {
 		}
 		return x
 	}
+	var pinned []*freqStats
 	for _, d := range domains {
 		min, max, avail := d.AvailableRange()
 		target := (max-min)*percent/100 + min
@@ -246,16 +1217,106 @@ func (s *Server) setGovernor(percent int) error {
 		if err != nil {
 			return err
 		}
+		// The userspace governor runs at the speed we set,
+		// rather than picking from the range.
+		if gov, _ := d.Governor(); gov == "userspace" {
+			if err := d.SetSpeed(target); err != nil {
+				return err
+			}
+		}
+		// In active mode, intel_pstate and amd-pstate pick
+		// frequencies in hardware, biased by the energy
+		// performance preference. Ask them to favor
+		// performance so they hold the frequency we set, if
+		// they can.
+		if _, err := d.EPP(); err == nil {
+			avail, err := d.AvailableEPPs()
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err != nil || slices.Contains(avail, "performance") {
+				if err := d.SetEPP("performance"); err != nil {
+					return err
+				}
+			} else {
+				s.logEvent(slog.LevelWarn, "tune", "domain does not support performance EPP", "domain", d.Name(), "available", avail)
+			}
+		}
+		pinned = append(pinned, &freqStats{domain: d, target: target})
 	}
 
+	s.hold.Governor = fmt.Sprintf("%d%%", percent)
+	// Check that the domains actually run at the target.
+	s.stopFreqMonitor()
+	s.freq = startFreqMonitor(pinned)
 	return nil
 }
 
+// checkThermal records in the hold whether the host's CPUs were
+// thermally throttled since the lock was granted. If they were, it
+// returns a warning for the client.
+func (s *Server) checkThermal() string {
+	if s.thermal == nil {
+		return ""
+	}
+	before := s.thermal
+	s.thermal = nil
+	after, err := takeThermalSnapshot()
+	if err != nil {
+		s.logEvent(slog.LevelWarn, "thermal", "reading thermal state", "err", err)
+		return ""
+	}
+	n, warning := after.throttlesSince(before)
+	if n == 0 {
+		return ""
+	}
+	s.hold.Throttles = n
+	s.logEvent(slog.LevelWarn, "thermal", "CPUs were thermally throttled during hold", "cmd", s.hold.Msg, "throttles", n)
+	return warning
+}
+
+// stopFreqMonitor stops sampling the frequency of the pinned domains,
+// logs the results, and returns them as a message for the client. It
+// returns "" if the daemon wasn't sampling.
+func (s *Server) stopFreqMonitor() string {
+	if s.freq == nil {
+		return ""
+	}
+	report, warnings, err := s.freq.finish()
+	s.freq = nil
+	if err != nil {
+		s.logEvent(slog.LevelWarn, "freq", "sampling CPU frequency", "err", err)
+	}
+	var lines []string
+	for _, r := range report {
+		s.logEvent(slog.LevelInfo, "freq", "measured CPU frequency", "report", r)
+		lines = append(lines, r)
+	}
+	for _, w := range warnings {
+		s.logEvent(slog.LevelWarn, "freq", "CPU frequency deviated from target", "warning", w)
+		lines = append(lines, "warning: "+w)
+	}
+	return strings.Join(lines, "\n")
+}
+
 func (s *Server) restoreGovernor() error {
 	var err error
+	// Restore turbo boost first, since disabling it may have
+	// limited the frequency ranges.
+	for _, t := range s.oldTurbo {
+		err1 := t.turbo.SetEnabled(t.enabled)
+		if err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	if s.oldPState != nil {
+		if err1 := s.oldPState.restore(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
 	for _, g := range s.oldGovernors {
 		// Try to set all of the domains, even if one fails.
-		err1 := g.domain.SetRange(g.min, g.max)
+		err1 := g.restore()
 		if err1 != nil && err == nil {
 			err = err1
 		}
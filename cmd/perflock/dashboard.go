@@ -0,0 +1,168 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aclements/perflock/internal/cpupower"
+)
+
+// serveDashboard serves a read-only status page on l. If this fails,
+// it logs the error and returns; the daemon carries on without the
+// status page.
+func serveDashboard(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", dashboardHandler)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: handshakeTimeout,
+		WriteTimeout:      writeTimeout,
+	}
+	if err := srv.Serve(l); !errors.Is(err, net.ErrClosed) {
+		slog.Error("serving status page", "event", "http", "err", err)
+	}
+}
+
+type dashboardData struct {
+	Now     time.Time
+	Queue   []dashboardHold
+	Domains []dashboardDomain
+	History []HoldRecord
+	Errors  []string
+}
+
+type dashboardHold struct {
+	HoldRecord
+	Held bool
+	// Elapsed is the time the request has been held or waiting.
+	Elapsed string
+	// Estimate is the estimated time until the request is
+	// released (if held) or acquired (if waiting).
+	Estimate string
+}
+
+type dashboardDomain struct {
+	Name               string
+	CPUs               string
+	Min, Max           int
+	AvailMin, AvailMax int
+}
+
+// dashboardAddr returns the address to serve the status page on for
+// the configured address addr. The page is unauthenticated and shows
+// users' commands, so a bare ":port" listens only on localhost.
+func dashboardAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	data := dashboardData{Now: now}
+
+	q := theLock.Queue()
+	sched := estimateSchedule(q, now, estimateFromHistory)
+	for i, h := range q {
+		d := dashboardHold{HoldRecord: h, Held: !h.Acquired.IsZero()}
+		if d.Held {
+			d.Elapsed = formatEstimate(now.Sub(h.Acquired))
+			if end := sched[i].end; !end.IsZero() {
+				d.Estimate = formatEstimate(end.Sub(now)) + " left"
+			}
+		} else {
+			d.Elapsed = formatEstimate(now.Sub(h.Enqueued))
+			if start := sched[i].start; !start.IsZero() {
+				d.Estimate = "starts in " + formatEstimate(start.Sub(now))
+			}
+		}
+		data.Queue = append(data.Queue, d)
+	}
+
+	domains, err := cpupower.Domains()
+	if err != nil {
+		data.Errors = append(data.Errors, "reading CPU frequency domains: "+err.Error())
+	}
+	for _, dom := range domains {
+		min, max, err := dom.CurrentRange()
+		if err != nil {
+			data.Errors = append(data.Errors, "reading CPU frequency: "+err.Error())
+			continue
+		}
+		amin, amax, _ := dom.AvailableRange()
+		data.Domains = append(data.Domains, dashboardDomain{dom.Name(), formatCPUs(dom.CPUs()), min, max, amin, amax})
+	}
+
+	data.History = theHistory.Recent(now.Add(-24 * time.Hour))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		slog.Warn("rendering dashboard", "err", err)
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"mhz": func(khz int) int { return khz / 1000 },
+	"duration": func(r HoldRecord) string {
+		return formatEstimate(r.Released.Sub(r.Acquired))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="10">
+<title>perflock{{if .Queue}} (busy){{else}} (free){{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; }
+td.cmd { font-family: monospace; }
+.status { font-size: 150%; font-weight: bold; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>perflock</h1>
+{{range .Errors}}<p class="error">{{.}}</p>
+{{end}}
+{{if .Queue}}<p class="status">Busy</p>
+<table>
+<tr><th>State</th><th>User</th><th>Mode</th><th>Command</th><th>Elapsed</th><th>Estimate</th></tr>
+{{range .Queue}}<tr><td>{{if .Held}}holding{{else}}waiting{{end}}</td><td>{{.Who}}</td><td>{{.Mode}}</td><td class="cmd">{{.Msg}}</td><td>{{.Elapsed}}</td><td>{{.Estimate}}</td></tr>
+{{end}}</table>
+{{else}}<p class="status">Free</p>
+{{end}}
+<h2>CPU frequency</h2>
+{{if .Domains}}<table>
+<tr><th>Domain</th><th>CPUs</th><th>Current range (MHz)</th><th>Available range (MHz)</th></tr>
+{{range .Domains}}<tr><td>{{.Name}}</td><td>{{.CPUs}}</td><td>{{mhz .Min}}&ndash;{{mhz .Max}}</td><td>{{mhz .AvailMin}}&ndash;{{mhz .AvailMax}}</td></tr>
+{{end}}</table>
+{{else}}<p>No CPU frequency domains.</p>
+{{end}}
+<h2>Recent history</h2>
+{{if .History}}<table>
+<tr><th>User</th><th>Mode</th><th>Command</th><th>Started</th><th>Duration</th><th>Exit</th></tr>
+{{range .History}}<tr><td>{{.Who}}</td><td>{{.Mode}}</td><td class="cmd">{{.Msg}}</td><td>{{.Acquired.Format "Jan _2 15:04:05"}}</td><td>{{duration .}}</td><td>{{if .Exited}}{{.ExitStatus}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>Nothing has run in the last 24 hours.</p>
+{{end}}
+<p><small>As of {{.Now.Format "Jan _2 15:04:05 MST"}}</small></p>
+</body>
+</html>
+`))
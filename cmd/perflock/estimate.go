@@ -0,0 +1,153 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A scheduleEntry is the estimated schedule of one lock request.
+type scheduleEntry struct {
+	// start and end are the estimated start and end times of the
+	// hold. They are zero if unknown.
+	start, end time.Time
+}
+
+// estimateSchedule estimates when each request in q will acquire and
+// release the lock, using estimate to predict the duration of each
+// hold. q must be in queue order, as returned by PerfLock.Queue.
+//
+// Requests are granted in groups: either a single exclusive request
+// or a run of consecutive shared requests, which hold the lock
+// together. Each group starts when the previous group has finished.
+// Once any request's duration is unknown, so is the schedule of all
+// later groups.
+func estimateSchedule(q []HoldRecord, now time.Time, estimate func(*HoldRecord) (time.Duration, bool)) []scheduleEntry {
+	sched := make([]scheduleEntry, len(q))
+	groupStart := now
+	for i := 0; i < len(q); {
+		// Find the end of this group.
+		j := i + 1
+		if q[i].Shared {
+			for j < len(q) && q[j].Shared {
+				j++
+			}
+		}
+
+		var groupEnd time.Time
+		known := !groupStart.IsZero()
+		for k := i; k < j; k++ {
+			start := groupStart
+			if !q[k].Acquired.IsZero() {
+				start = q[k].Acquired
+			}
+			d, ok := estimate(&q[k])
+			if !ok || start.IsZero() {
+				known = false
+				continue
+			}
+			end := start.Add(d)
+			if end.Before(now) {
+				// This hold is overdue. Assume it will
+				// finish any moment.
+				end = now
+			}
+			sched[k] = scheduleEntry{start, end}
+			if end.After(groupEnd) {
+				groupEnd = end
+			}
+		}
+		if !known {
+			// Any of this group could finish last, so we
+			// don't know when the next group will start.
+			groupEnd = time.Time{}
+		}
+		for k := i; k < j; k++ {
+			if q[k].Acquired.IsZero() {
+				sched[k].start = groupStart
+			}
+		}
+		groupStart = groupEnd
+		i = j
+	}
+	return sched
+}
+
+// estimateFromHistory estimates the duration of hold from the
+// history log.
+func estimateFromHistory(hold *HoldRecord) (time.Duration, bool) {
+	return theHistory.EstimateHold(hold.User, hold.Msg, hold.Shared)
+}
+
+// estimateWait estimates how long a new request for hold would wait
+// given the current queue. It returns false if this is unknown.
+func estimateWait(q []HoldRecord, hold HoldRecord, now time.Time) (time.Duration, bool) {
+	i := enqueuePosition(q, hold)
+	q = append(q[:i:i], append([]HoldRecord{hold}, q[i:]...)...)
+	sched := estimateSchedule(q, now, estimateFromHistory)
+	start := sched[i].start
+	if start.IsZero() {
+		return 0, false
+	}
+	return start.Sub(now), true
+}
+
+// enqueuePosition returns the index in q at which PerfLock.Enqueue
+// would place a new request for hold.
+func enqueuePosition(q []HoldRecord, hold HoldRecord) int {
+	i := len(q)
+	if !hold.Demoted {
+		// Go ahead of any waiting demoted requests.
+		for i > 0 && q[i-1].Demoted && q[i-1].Acquired.IsZero() {
+			i--
+		}
+	}
+	return i
+}
+
+// formatQueue formats the lock queue q for display, including
+// estimated times for each request.
+func formatQueue(q []HoldRecord, now time.Time) []string {
+	sched := estimateSchedule(q, now, estimateFromHistory)
+	var out []string
+	for i, h := range q {
+		msg := fmt.Sprintf("%s\t%s\t%s", h.Who(), h.Enqueued.Format(time.Stamp), h.Msg)
+		if h.Shared {
+			msg += " [shared]"
+		}
+		if h.Demoted {
+			msg += " [low priority]"
+		}
+		if h.PID != 0 {
+			msg += fmt.Sprintf(" [pid %d", h.PID)
+			if h.Cgroup != "" {
+				msg += " in " + h.Cgroup
+			}
+			msg += "]"
+		}
+		if !h.Acquired.IsZero() {
+			if end := sched[i].end; !end.IsZero() {
+				msg += fmt.Sprintf(" [est. %s left]", formatEstimate(end.Sub(now)))
+			}
+		} else if start := sched[i].start; !start.IsZero() {
+			msg += fmt.Sprintf(" [est. start in %s]", formatEstimate(start.Sub(now)))
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// formatEstimate formats an estimated duration for display.
+func formatEstimate(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", (d+time.Minute/2)/time.Minute)
+	}
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh%dm", d/time.Hour, (d%time.Hour)/time.Minute)
+}
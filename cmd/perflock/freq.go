@@ -0,0 +1,189 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aclements/perflock/internal/cpupower"
+)
+
+// freqSampleInterval is how often the daemon samples the frequency
+// of the domains it has pinned while the command runs.
+const freqSampleInterval = time.Second
+
+// freqTolerance is how far the mean achieved frequency of a domain
+// may be from its target, as a fraction of the target, before the
+// daemon warns about it.
+const freqTolerance = 0.05
+
+// freqMonitor samples the frequency the pinned domains actually run
+// at, so the daemon can tell the client if the hardware or firmware
+// ignored the requested frequency.
+type freqMonitor struct {
+	stop, done chan struct{}
+
+	// mu protects the samples in domains, which the sampling
+	// goroutine adds to until done is closed.
+	mu      sync.Mutex
+	domains []*freqStats
+}
+
+// freqStats are the frequency samples of one domain.
+type freqStats struct {
+	domain  *cpupower.Domain
+	target  int
+	sampler *cpupower.FrequencySampler
+
+	n             int
+	min, max, sum int
+	err           error
+}
+
+// savedFreqStats are the frequency samples of one domain, passed to a
+// new daemon on handoff so it can carry on sampling.
+type savedFreqStats struct {
+	// Domain is the sysfs path of the frequency domain.
+	Domain           string
+	Target           int
+	N, Min, Max, Sum int
+}
+
+// stats returns the samples s records for domain d.
+func (s savedFreqStats) stats(d *cpupower.Domain) *freqStats {
+	return &freqStats{domain: d, target: s.Target, n: s.N, min: s.Min, max: s.Max, sum: s.Sum}
+}
+
+// startFreqMonitor starts sampling the frequency of each domain in
+// domains, which must have their domain and target set.
+func startFreqMonitor(domains []*freqStats) *freqMonitor {
+	m := &freqMonitor{stop: make(chan struct{}), done: make(chan struct{}), domains: domains}
+	for _, st := range domains {
+		st.sampler = st.domain.NewFrequencySampler()
+	}
+	go m.run()
+	return m
+}
+
+func (m *freqMonitor) run() {
+	defer close(m.done)
+	// Don't sample right away, since the kernel's reported
+	// frequency may not have caught up with the new settings.
+	t := time.NewTicker(freqSampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.sample()
+		case <-m.stop:
+			m.sample()
+			return
+		}
+	}
+}
+
+func (m *freqMonitor) sample() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, st := range m.domains {
+		if st.err != nil {
+			continue
+		}
+		freq, ok, err := st.sampler.Sample()
+		if err != nil {
+			st.err = err
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if st.n == 0 || freq < st.min {
+			st.min = freq
+		}
+		if freq > st.max {
+			st.max = freq
+		}
+		st.sum += freq
+		st.n++
+	}
+}
+
+// saved returns the samples so far, to pass to a new daemon.
+func (m *freqMonitor) saved() []savedFreqStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var saved []savedFreqStats
+	for _, st := range m.domains {
+		saved = append(saved, savedFreqStats{st.domain.Path(), st.target, st.n, st.min, st.max, st.sum})
+	}
+	return saved
+}
+
+// finish stops m and returns a report of the frequencies the domains
+// achieved, with a line for each distinct target frequency, warnings
+// about domains whose mean frequency deviated from their target, and
+// the first error sampling any domain. The report omits targets with
+// no samples.
+func (m *freqMonitor) finish() (report, warnings []string, err error) {
+	close(m.stop)
+	<-m.done
+
+	// Domains with the same target are summarized together.
+	type group struct {
+		target        int
+		cpus          []int
+		n             int
+		min, max, sum int
+		sources       []string
+	}
+	var groups []*group
+	for _, st := range m.domains {
+		st.sampler.Close()
+		if st.err != nil && err == nil {
+			err = fmt.Errorf("sampling %s frequency: %w", st.domain.Name(), st.err)
+		}
+		if st.n == 0 {
+			continue
+		}
+		i := slices.IndexFunc(groups, func(g *group) bool { return g.target == st.target })
+		if i < 0 {
+			i = len(groups)
+			groups = append(groups, &group{target: st.target})
+		}
+		g := groups[i]
+		g.cpus = append(g.cpus, st.domain.CPUs()...)
+		if g.n == 0 || st.min < g.min {
+			g.min = st.min
+		}
+		if st.max > g.max {
+			g.max = st.max
+		}
+		g.n, g.sum = g.n+st.n, g.sum+st.sum
+		if src := st.sampler.Source(); !slices.Contains(g.sources, src) {
+			g.sources = append(g.sources, src)
+		}
+
+		mean := st.sum / st.n
+		if dev := float64(mean-st.target) / float64(st.target); dev > freqTolerance || dev < -freqTolerance {
+			dir := "above"
+			if dev < 0 {
+				dir, dev = "below", -dev
+			}
+			warnings = append(warnings, fmt.Sprintf("%s (CPUs %s) averaged %d MHz, %.0f%% %s its %d MHz target; the hardware or firmware may be overriding the requested frequency",
+				st.domain.Name(), formatCPUs(st.domain.CPUs()), mean/1000, dev*100, dir, st.target/1000))
+		}
+	}
+	for _, g := range groups {
+		sort.Ints(g.cpus)
+		report = append(report, fmt.Sprintf("CPU frequency during run on CPUs %s: %d-%d MHz, mean %d MHz (target %d MHz, from %s)",
+			formatCPUs(g.cpus), g.min/1000, g.max/1000, g.sum/g.n/1000, g.target/1000, strings.Join(g.sources, " and ")))
+	}
+	return report, warnings, err
+}
@@ -0,0 +1,641 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aclements/perflock/internal/cpupower"
+)
+
+// Hot upgrade
+//
+// When the daemon receives SIGUSR2, it replaces itself with a new
+// daemon process running the current perflock executable, without
+// dropping any locks:
+//
+//  1. The old daemon stops accepting connections and asks each Server
+//     to quiesce. Once a client is either waiting for the lock or
+//     holding it and only reading Notices, its Server sends it a Reset.
+//     The client replies with ActionReset to end its gob stream and
+//     starts new gob streams in both directions, since the new daemon
+//     won't know the type information sent on the old streams.
+//
+//  2. The old daemon starts the new daemon, passing it one end of a
+//     socket pair, and sends it the daemon state followed by the
+//     listening sockets and client connections.
+//
+//  3. The new daemon rebuilds the lock queue and tells the old daemon
+//     it is ready. The old daemon exits without releasing any locks or
+//     restoring CPU settings, and the new daemon starts serving.
+//
+// If the new daemon fails to start, the old daemon resumes serving the
+// client connections itself, using the new streams. Clients that
+// don't support handoff, or that don't quiesce within handoffTimeout,
+// are shut down as if the daemon were exiting.
+
+const (
+	// handoffEnv is the environment variable that tells a new
+	// daemon which file descriptor to receive the handoff on.
+	handoffEnv = "PERFLOCK_HANDOFF_FD"
+
+	// handoffTimeout bounds how long the daemon waits for clients
+	// to quiesce and for the new daemon to take over.
+	handoffTimeout = 10 * time.Second
+
+	// handoffMaxFDs is the most file descriptors Linux can pass in
+	// one message (SCM_MAX_FD).
+	handoffMaxFDs = 253
+)
+
+// handoffState is the daemon state passed to a new daemon. It is
+// followed by messages carrying the file descriptors of the
+// listening socket, the status page listener if HTTP is set, the PID
+// file if PIDFile is set, and the connection of each of Conns, in
+// that order.
+type handoffState struct {
+	HTTP    bool
+	PIDFile string
+
+	NextConnID uint64
+	Started    time.Time
+	Saved      []savedTuning
+
+	// Conns lists the connections that are in the lock queue, in
+	// queue order, followed by the rest.
+	Conns []handoffConn
+}
+
+// handoffConn is the state of one client connection.
+type handoffConn struct {
+	ID       uint64
+	UID      string
+	RealUser string
+	PID      int
+	Version  int
+
+	Handoff, Watching, Acquiring bool
+
+	// Queued indicates the connection is in the lock queue, in
+	// which case Woken indicates the lock has been granted to it.
+	Queued, Woken bool
+
+	Hold      HoldRecord
+	Governors []savedRange
+	Turbo     []savedTurbo
+	PerfPct   *savedPerfPct
+	Thermal   *thermalSnapshot
+	// Freq is the frequency samples of the domains the client
+	// pinned, if the daemon is sampling them.
+	Freq []savedFreqStats
+}
+
+// upgrade replaces this daemon with a new daemon process, handing it
+// the listening sockets l and hl (which may be nil) and all client
+// connections. If this succeeds, upgrade exits without releasing any
+// locks or restoring CPU settings, since the new daemon now owns them.
+// Otherwise, this daemon carries on.
+func upgrade(l, hl net.Listener) {
+	slog.Info("handing off to new daemon", "event", "handoff")
+	resumeAccept, err := pauseAccept(l)
+	if err != nil {
+		slog.Error("handoff failed", "event", "handoff", "err", err)
+		return
+	}
+	defer resumeAccept()
+
+	ready := quiesce()
+	// Post-release hooks hold the lock until they finish, and the
+	// new daemon can't take over that.
+	pendingHooks.Wait()
+	pid, err := startSuccessor(l, hl, ready)
+	if err != nil {
+		slog.Error("handoff failed; resuming service", "event", "handoff", "err", err)
+		servers.Lock()
+		servers.handoff = make(chan struct{})
+		servers.Unlock()
+		for _, s := range ready {
+			s.resume <- false
+		}
+		return
+	}
+
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", pid)); err != nil {
+		slog.Warn("notifying systemd", "err", err)
+	}
+	slog.Info("handed off to new daemon", "event", "handoff", "pid", pid, "conns", len(ready))
+	os.Exit(0)
+}
+
+// acceptGate lets a handoff pause the daemon's accept loop.
+var acceptGate struct {
+	sync.Mutex
+	// resume is non-nil while accepting is paused, and is closed
+	// to resume accepting.
+	resume chan struct{}
+	// parked is closed once the accept loop has stopped.
+	parked chan struct{}
+}
+
+// pauseAccept stops the accept loop on l and returns a function that
+// restarts it.
+func pauseAccept(l net.Listener) (resume func(), err error) {
+	dl, ok := l.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		return nil, fmt.Errorf("can't interrupt %T", l)
+	}
+	resumeC, parked := make(chan struct{}), make(chan struct{})
+	acceptGate.Lock()
+	acceptGate.resume, acceptGate.parked = resumeC, parked
+	acceptGate.Unlock()
+
+	// Interrupt any blocked Accept.
+	if err := dl.SetDeadline(time.Unix(1, 0)); err != nil {
+		return nil, err
+	}
+	<-parked
+	return func() {
+		dl.SetDeadline(time.Time{})
+		acceptGate.Lock()
+		acceptGate.resume, acceptGate.parked = nil, nil
+		acceptGate.Unlock()
+		close(resumeC)
+	}, nil
+}
+
+// acceptPaused is called by the accept loop when Accept fails. If
+// accepting is paused, it waits until it resumes and returns true.
+func acceptPaused() bool {
+	acceptGate.Lock()
+	resume, parked := acceptGate.resume, acceptGate.parked
+	acceptGate.Unlock()
+	if resume == nil {
+		return false
+	}
+	close(parked)
+	<-resume
+	return true
+}
+
+// quiesce asks all Servers to prepare their connections for a
+// handoff and returns those that are ready. Servers that aren't ready
+// within handoffTimeout are shut down.
+func quiesce() []*Server {
+	servers.Lock()
+	if servers.handoff == nil {
+		servers.handoff = make(chan struct{})
+	}
+	close(servers.handoff)
+	var all []*Server
+	for s := range servers.m {
+		all = append(all, s)
+	}
+	servers.Unlock()
+
+	var ready, late []*Server
+	timeout := time.After(handoffTimeout)
+	timedOut := false
+	for _, s := range all {
+		if !timedOut {
+			select {
+			case <-s.quiesced:
+				ready = append(ready, s)
+				continue
+			case <-s.done:
+				continue
+			case <-timeout:
+				timedOut = true
+			}
+		}
+		select {
+		case <-s.quiesced:
+			ready = append(ready, s)
+		case <-s.done:
+		default:
+			late = append(late, s)
+		}
+	}
+
+	for _, s := range late {
+		s.log.Warn("client did not quiesce for handoff; shutting down connection", "event", "handoff")
+		s.stopServing()
+		// It may have quiesced in the meantime.
+		select {
+		case <-s.quiesced:
+			ready = append(ready, s)
+		case <-s.done:
+		}
+	}
+	return ready
+}
+
+// startSuccessor starts a new daemon and hands it the listening
+// sockets and the connections of ready. It returns the PID of the new
+// daemon once it has taken over.
+func startSuccessor(l, hl net.Listener, ready []*Server) (int, error) {
+	st := handoffState{
+		HTTP:       hl != nil,
+		NextConnID: nextConnID.Load(),
+		Started:    daemonStarted,
+		Saved:      theState.Saved(),
+	}
+
+	// Collect the file descriptors to pass. File returns
+	// duplicates, which we close once they're sent.
+	var fds []int
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	addFD := func(x interface{ File() (*os.File, error) }) error {
+		f, err := x.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		fds = append(fds, int(f.Fd()))
+		return nil
+	}
+	if err := addFD(l.(interface{ File() (*os.File, error) })); err != nil {
+		return 0, err
+	}
+	if hl != nil {
+		if err := addFD(hl.(interface{ File() (*os.File, error) })); err != nil {
+			return 0, err
+		}
+	}
+	if pidFile != nil {
+		st.PIDFile = pidFile.Name()
+		fds = append(fds, int(pidFile.Fd()))
+	}
+
+	// Pass the connections in lock queue order.
+	pos := make(map[*Locker]int)
+	for i, locker := range theLock.Lockers() {
+		pos[locker] = i
+	}
+	order := func(s *Server) int {
+		if i, ok := pos[s.locker]; ok {
+			return i
+		}
+		return len(pos)
+	}
+	sort.SliceStable(ready, func(i, j int) bool { return order(ready[i]) < order(ready[j]) })
+	for _, s := range ready {
+		st.Conns = append(st.Conns, s.handoffState())
+		if err := addFD(s.c.(interface{ File() (*os.File, error) })); err != nil {
+			return 0, err
+		}
+	}
+	pair, err := socketpair()
+	if err != nil {
+		return 0, err
+	}
+	ours, theirs := os.NewFile(uintptr(pair[0]), "handoff"), os.NewFile(uintptr(pair[1]), "handoff")
+	defer theirs.Close()
+	c, err := net.FileConn(ours)
+	ours.Close()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	uc := c.(*net.UnixConn)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Env = append(handoffEnviron(), fmt.Sprintf("%s=%d", handoffEnv, 3))
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	theirs.Close()
+	ok := false
+	defer func() {
+		if !ok {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}()
+
+	uc.SetDeadline(time.Now().Add(handoffTimeout))
+	if err := gob.NewEncoder(uc).Encode(&st); err != nil {
+		return 0, err
+	}
+	if err := sendFDs(uc, fds); err != nil {
+		return 0, err
+	}
+	var reply string
+	if err := gob.NewDecoder(unbufferedReader{uc}).Decode(&reply); err != nil {
+		return 0, fmt.Errorf("new daemon failed: %w", err)
+	}
+	if reply != "" {
+		return 0, fmt.Errorf("new daemon failed: %s", reply)
+	}
+	ok = true
+	return cmd.Process.Pid, nil
+}
+
+// socketpair returns a connected pair of close-on-exec UNIX stream
+// sockets.
+func socketpair() ([2]int, error) {
+	// Not every OS has SOCK_CLOEXEC, so hold ForkLock to keep
+	// other goroutines from leaking these into a child before
+	// they're marked close-on-exec.
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return pair, err
+	}
+	syscall.CloseOnExec(pair[0])
+	syscall.CloseOnExec(pair[1])
+	return pair, nil
+}
+
+// sendFDs sends fds over uc, in as many messages as it takes.
+func sendFDs(uc *net.UnixConn, fds []int) error {
+	for len(fds) > 0 {
+		n := min(len(fds), handoffMaxFDs)
+		if _, _, err := uc.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds[:n]...), nil); err != nil {
+			return err
+		}
+		fds = fds[n:]
+	}
+	return nil
+}
+
+// receiveFDs receives n file descriptors sent over uc by sendFDs.
+func receiveFDs(uc *net.UnixConn, n int) ([]int, error) {
+	var fds []int
+	for len(fds) < n {
+		want := min(n-len(fds), handoffMaxFDs)
+		oob := make([]byte, syscall.CmsgSpace(want*4))
+		_, oobn, _, _, err := uc.ReadMsgUnix(make([]byte, 1), oob)
+		if err != nil {
+			return fds, err
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			return fds, fmt.Errorf("bad control message")
+		}
+		got, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			return fds, err
+		}
+		fds = append(fds, got...)
+	}
+	if len(fds) != n {
+		return fds, fmt.Errorf("got %d file descriptors, want %d", len(fds), n)
+	}
+	return fds, nil
+}
+
+// handoffEnviron returns the environment for a new daemon.
+func handoffEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		// The watchdog belongs to the new daemon once we
+		// tell systemd its PID.
+		if strings.HasPrefix(kv, "WATCHDOG_PID=") || strings.HasPrefix(kv, handoffEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// handoffState returns the state of s's connection for a handoff. s
+// must be quiesced.
+func (s *Server) handoffState() handoffConn {
+	hc := handoffConn{
+		ID:        s.id,
+		UID:       s.ident.uid,
+		RealUser:  s.realUser,
+		PID:       s.pid,
+		Version:   s.version,
+		Handoff:   s.handoff,
+		Watching:  s.watching,
+		Acquiring: s.acquiring,
+		Hold:      s.hold,
+	}
+	if s.locker != nil {
+		hc.Queued = true
+		hc.Woken = theLock.Woken(s.locker)
+	}
+	for _, g := range s.oldGovernors {
+		hc.Governors = append(hc.Governors, g.saved())
+	}
+	for _, t := range s.oldTurbo {
+		hc.Turbo = append(hc.Turbo, savedTurbo{t.turbo.Path(), t.enabled})
+	}
+	hc.PerfPct = s.oldPState.saved()
+	hc.Thermal = s.thermal
+	if s.freq != nil {
+		hc.Freq = s.freq.saved()
+	}
+	return hc
+}
+
+// inheritedDaemon is the state received from a daemon that is handing
+// off to this one.
+type inheritedDaemon struct {
+	c     *net.UnixConn
+	state handoffState
+
+	listener, http net.Listener
+	conns          []net.Conn
+}
+
+// receiveHandoff receives the state of the daemon handing off to this
+// one over file descriptor fd.
+func receiveHandoff(fd string) (*inheritedDaemon, error) {
+	os.Unsetenv(handoffEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %w", handoffEnv, err)
+	}
+	f := os.NewFile(uintptr(n), "handoff")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	h := &inheritedDaemon{c: c.(*net.UnixConn)}
+
+	if err := gob.NewDecoder(unbufferedReader{h.c}).Decode(&h.state); err != nil {
+		return nil, fmt.Errorf("receiving handoff: %w", err)
+	}
+	nfds := 1 + len(h.state.Conns)
+	if h.state.HTTP {
+		nfds++
+	}
+	if h.state.PIDFile != "" {
+		nfds++
+	}
+	fds, err := receiveFDs(h.c, nfds)
+	if err != nil {
+		return nil, fmt.Errorf("receiving handoff: %w", err)
+	}
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+	}
+	next := func(name string) *os.File {
+		f := os.NewFile(uintptr(fds[0]), name)
+		fds = fds[1:]
+		return f
+	}
+
+	f = next("listener")
+	h.listener, err = net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if h.state.HTTP {
+		f := next("http listener")
+		h.http, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.state.PIDFile != "" {
+		// We inherit the lock on the PID file.
+		pidFile = next(h.state.PIDFile)
+		if err := pidFile.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := pidFile.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+			return nil, err
+		}
+	}
+	for range h.state.Conns {
+		f := next("conn")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		h.conns = append(h.conns, c)
+	}
+	return h, nil
+}
+
+// resume rebuilds the lock queue and Servers from the inherited
+// state, tells the old daemon this daemon is taking over, and starts
+// serving once the old daemon has exited.
+func (h *inheritedDaemon) resume() error {
+	ss, err := h.servers()
+	reply := ""
+	if err != nil {
+		reply = err.Error()
+	}
+	if err := gob.NewEncoder(h.c).Encode(reply); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// Wait for the old daemon to exit so we don't both serve the
+	// connections.
+	io.Copy(io.Discard, h.c)
+	h.c.Close()
+
+	theLock.Wake()
+	for _, s := range ss {
+		startServer(s)
+	}
+	slog.Info("took over from old daemon", "event", "handoff", "conns", len(ss))
+	return nil
+}
+
+// servers returns Servers for the inherited connections and restores
+// their places in the lock queue.
+func (h *inheritedDaemon) servers() ([]*Server, error) {
+	nextConnID.Store(h.state.NextConnID)
+	var byPath map[string]*cpupower.Domain
+	domain := func(path string) (*cpupower.Domain, error) {
+		if byPath == nil {
+			var err error
+			if byPath, err = domainsByPath(); err != nil {
+				return nil, err
+			}
+		}
+		d := byPath[path]
+		if d == nil {
+			return nil, fmt.Errorf("unknown frequency domain %s", path)
+		}
+		return d, nil
+	}
+	cfg := currentConfig()
+	var ss []*Server
+	for i, hc := range h.state.Conns {
+		s := newServer(h.conns[i], hc.ID)
+		s.setClient(hc.UID, hc.PID, hc.RealUser)
+		s.version = hc.Version
+		s.handoff, s.watching, s.acquiring = hc.Handoff, hc.Watching, hc.Acquiring
+		s.hold = hc.Hold
+		for _, r := range hc.Governors {
+			d, err := domain(r.Domain)
+			if err != nil {
+				return nil, err
+			}
+			s.oldGovernors = append(s.oldGovernors, r.settings(d))
+		}
+		for _, t := range hc.Turbo {
+			s.oldTurbo = append(s.oldTurbo, &turboSettings{cpupower.NewTurbo(t.Path), t.Enabled})
+		}
+		s.oldPState = hc.PerfPct.settings()
+		s.thermal = hc.Thermal
+		if len(hc.Freq) > 0 {
+			// Carry on sampling the pinned domains.
+			var pinned []*freqStats
+			for _, f := range hc.Freq {
+				d, err := domain(f.Domain)
+				if err != nil {
+					return nil, err
+				}
+				pinned = append(pinned, f.stats(d))
+			}
+			s.freq = startFreqMonitor(pinned)
+		}
+		if hc.Queued {
+			s.locker = theLock.Restore(hc.Hold, hc.Woken)
+			switch {
+			case hc.Acquiring && hc.Woken:
+				// The old daemon granted the lock but
+				// hadn't finished the pre-grant hook.
+				// Run it again now.
+				retry := make(chan time.Time, 1)
+				retry <- time.Now()
+				s.retryC = retry
+			case hc.Acquiring:
+				s.acquireC = s.locker.C
+			case cfg.maxHold > 0:
+				s.lease = time.After(time.Until(hc.Hold.Acquired.Add(cfg.maxHold)))
+			}
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
@@ -0,0 +1,397 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HoldRecord records a single completed hold of the lock.
+type HoldRecord struct {
+	User string
+	// RealUser is the user who originally logged in, if the
+	// client was running as a different user, such as under sudo.
+	RealUser string `json:",omitempty"`
+
+	Msg    string
+	Shared bool
+	// Demoted indicates the request was over quota and was
+	// queued at low priority.
+	Demoted bool `json:",omitempty"`
+
+	// PID and Cgroup identify the client process that made the
+	// request, if known.
+	PID    int    `json:",omitempty"`
+	Cgroup string `json:",omitempty"`
+
+	Enqueued time.Time
+	Acquired time.Time
+	Released time.Time
+
+	// Governor is the CPU governor setting applied during the
+	// hold, or "" if the governor was not changed.
+	Governor string `json:",omitempty"`
+	// Turbo is "on" or "off" if turbo boost was set during the
+	// hold, or "" if it was not changed.
+	Turbo string `json:",omitempty"`
+	// CPUGovernor is the kernel scaling governor set during the
+	// hold, or "" if it was not changed.
+	CPUGovernor string `json:",omitempty"`
+
+	// Throttles is the number of thermal throttling events on the
+	// host's CPUs during the hold.
+	Throttles int `json:",omitempty"`
+
+	// Exited is true if the client reported the exit status of
+	// its command, in which case ExitStatus is that status.
+	Exited     bool `json:",omitempty"`
+	ExitStatus int  `json:",omitempty"`
+}
+
+// Mode returns "shared" or "exclusive".
+func (r *HoldRecord) Mode() string {
+	if r.Shared {
+		return "shared"
+	}
+	return "exclusive"
+}
+
+// Who returns the user who made the request, such as "alice" or
+// "alice (as root)".
+func (r *HoldRecord) Who() string {
+	if r.RealUser != "" {
+		return r.RealUser + " (as " + r.User + ")"
+	}
+	return r.User
+}
+
+// QuotaUser returns the user a hold counts against for quotas: the
+// real user if there is one, otherwise User.
+func (r *HoldRecord) QuotaUser() string {
+	if r.RealUser != "" {
+		return r.RealUser
+	}
+	return r.User
+}
+
+func (r *HoldRecord) String() string {
+	s := fmt.Sprintf("%s\t%s\t%s\t%s", r.Who(), r.Acquired.Format("2006-01-02 15:04:05"), r.Released.Sub(r.Acquired).Round(time.Second), r.Msg)
+	if r.Shared {
+		s += " [shared]"
+	}
+	if r.Governor != "" {
+		s += " [governor " + r.Governor + "]"
+	}
+	if r.Turbo != "" {
+		s += " [turbo " + r.Turbo + "]"
+	}
+	if r.CPUGovernor != "" {
+		s += " [cpugov " + r.CPUGovernor + "]"
+	}
+	if r.Throttles != 0 {
+		s += fmt.Sprintf(" [throttled %d]", r.Throttles)
+	}
+	if r.Exited {
+		s += fmt.Sprintf(" [exit %d]", r.ExitStatus)
+	}
+	return s
+}
+
+// History is an append-only log of completed holds. It is stored
+// on disk as a sequence of JSON-encoded HoldRecords, one per line.
+//
+// A nil *History discards all records.
+type History struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+
+	// durations records the most recent hold durations of each
+	// command, for estimating how long future holds will take.
+	durations map[holdKey][]time.Duration
+
+	// recent is the most recent maxRecent records, oldest first,
+	// for the status page.
+	recent []HoldRecord
+
+	// exclusive records the exclusive holds of each user (by
+	// QuotaUser) released within the last quotaWindow, oldest
+	// first, for enforcing quotas without re-reading the log.
+	quotaWindow time.Duration
+	exclusive   map[string][]HoldRecord
+}
+
+// holdKey identifies repeated runs of the same command.
+type holdKey struct {
+	user, msg string
+	shared    bool
+}
+
+// maxHistoryLine is the longest record Query will decode. Longer
+// lines are skipped.
+const maxHistoryLine = 1 << 20
+
+// maxRecent is the number of recent records History keeps in
+// memory for the status page.
+const maxRecent = 20
+
+// maxDurations is the number of recent hold durations History
+// keeps for each holdKey.
+const maxDurations = 10
+
+var theHistory *History
+
+// OpenHistory opens the history log at path, creating it if
+// necessary.
+func OpenHistory(path string) (*History, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := endPartialLine(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h := &History{path: path, f: f, durations: make(map[holdKey][]time.Duration), exclusive: make(map[string][]HoldRecord)}
+
+	// Index the existing log.
+	recs, err := h.Query("", time.Time{})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for i := range recs {
+		h.addDuration(&recs[i])
+		h.addRecent(&recs[i])
+	}
+	return h, nil
+}
+
+// endPartialLine terminates a partial record left at the end of the
+// log by a crash, so the next record starts on a line of its own.
+func endPartialLine(f *os.File) error {
+	r, err := os.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := r.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = f.Write([]byte{'\n'})
+	}
+	return err
+}
+
+func (h *History) addDuration(r *HoldRecord) {
+	k := holdKey{r.User, r.Msg, r.Shared}
+	ds := append(h.durations[k], r.Released.Sub(r.Acquired))
+	if len(ds) > maxDurations {
+		ds = ds[len(ds)-maxDurations:]
+	}
+	h.durations[k] = ds
+}
+
+func (h *History) addRecent(r *HoldRecord) {
+	h.recent = append(h.recent, *r)
+	if len(h.recent) > maxRecent {
+		h.recent = append(h.recent[:0], h.recent[len(h.recent)-maxRecent:]...)
+	}
+}
+
+// Recent returns up to maxRecent of the latest records that were
+// released at or after since, newest first.
+func (h *History) Recent(since time.Time) []HoldRecord {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []HoldRecord
+	for i := len(h.recent) - 1; i >= 0 && !h.recent[i].Released.Before(since); i-- {
+		out = append(out, h.recent[i])
+	}
+	return out
+}
+
+func (h *History) addExclusive(r *HoldRecord) {
+	if r.Shared || h.quotaWindow == 0 {
+		return
+	}
+	// Keep only what quotas need.
+	hold := HoldRecord{User: r.User, RealUser: r.RealUser, Acquired: r.Acquired, Released: r.Released}
+	cutoff := r.Released.Add(-h.quotaWindow)
+	user := r.QuotaUser()
+	hs := h.exclusive[user]
+	i := 0
+	for i < len(hs) && hs[i].Released.Before(cutoff) {
+		i++
+	}
+	h.exclusive[user] = append(hs[i:], hold)
+}
+
+// SetQuotaWindow sets how far back ExclusiveHolds must reach. If
+// this is longer than the previous window, it re-reads the log.
+func (h *History) SetQuotaWindow(window time.Duration) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	grow := window > h.quotaWindow
+	h.quotaWindow = window
+	if window == 0 {
+		clear(h.exclusive)
+		return nil
+	}
+	if !grow {
+		// Older holds are pruned as new ones are added.
+		return nil
+	}
+	// Hold mu while reading so no Append slips in between the
+	// read and the new index.
+	recs, err := h.Query("", time.Now().Add(-window))
+	clear(h.exclusive)
+	for i := range recs {
+		h.addExclusive(&recs[i])
+	}
+	return err
+}
+
+// ExclusiveHolds returns the exclusive holds charged to user (see
+// HoldRecord.QuotaUser) that were released at or after since. since
+// must be within the window set by SetQuotaWindow.
+func (h *History) ExclusiveHolds(user string, since time.Time) []HoldRecord {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []HoldRecord
+	for _, r := range h.exclusive[user] {
+		if !r.Released.Before(since) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// EstimateHold returns the expected duration of a hold by user
+// running msg, based on the median of recent runs of the same
+// command. It returns false if there is no history for this
+// command.
+func (h *History) EstimateHold(user, msg string, shared bool) (time.Duration, bool) {
+	if h == nil {
+		return 0, false
+	}
+	h.mu.Lock()
+	ds := append([]time.Duration(nil), h.durations[holdKey{user, msg, shared}]...)
+	h.mu.Unlock()
+	if len(ds) == 0 {
+		return 0, false
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds[len(ds)/2], true
+}
+
+// Append adds r to the history log.
+func (h *History) Append(r *HoldRecord) error {
+	if h == nil {
+		return nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addDuration(r)
+	h.addRecent(r)
+	h.addExclusive(r)
+	_, err = h.f.Write(data)
+	return err
+}
+
+// Query returns the records in the history log for the given user
+// that were released at or after since. If user is "", it returns
+// records for all users.
+func (h *History) Query(user string, since time.Time) ([]HoldRecord, error) {
+	if h == nil {
+		return nil, nil
+	}
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []HoldRecord
+	br := bufio.NewReaderSize(f, maxHistoryLine)
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Skip the rest of an over-long line.
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			line = nil
+		}
+		if err == io.EOF && len(line) == 0 {
+			return out, nil
+		} else if err != nil && err != io.EOF {
+			return out, err
+		}
+		var r HoldRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			// Skip corrupted records, such as a partial
+			// line left behind by a crash.
+			continue
+		}
+		if user != "" && r.User != user && r.RealUser != user {
+			continue
+		}
+		if r.Released.Before(since) {
+			continue
+		}
+		out = append(out, r)
+	}
+}
+
+// parseSince parses a -since argument. This may be either a
+// duration before now, a date, or a date and time.
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q: must be a duration (e.g., 24h) or a date (e.g., 2006-01-02)", s)
+}
@@ -0,0 +1,209 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Hook events.
+const (
+	// hookPreExclusive runs before granting an exclusive lock.
+	hookPreExclusive = "pre-exclusive"
+	// hookShared runs before granting a shared lock.
+	hookShared = "shared"
+	// hookPostRelease runs after any lock is released.
+	hookPostRelease = "post-release"
+)
+
+const (
+	// defaultHookTimeout is the default maximum time a hook may
+	// run before it is killed and considered failed. It is shorter
+	// than shutdownTimeout so the daemon can wait for post-release
+	// hooks when it shuts down.
+	defaultHookTimeout = 20 * time.Second
+
+	// hookWaitDelay is how long to wait for a killed hook to exit
+	// before giving up on it.
+	hookWaitDelay = 5 * time.Second
+
+	// maxHookOutput is the most hook output the daemon logs.
+	maxHookOutput = 64 << 10
+
+	// hookTempFail is the exit status (EX_TEMPFAIL) a pre-grant
+	// hook uses to ask the daemon to delay the grant and run the
+	// hook again after hookRetryDelay. Any other non-zero exit
+	// status vetoes the grant.
+	hookTempFail   = 75
+	hookRetryDelay = 30 * time.Second
+)
+
+// errHookDelay indicates that a hook asked to delay the grant.
+var errHookDelay = errors.New("hook requested delay")
+
+// pendingHooks tracks running post-release hooks, which hold the lock
+// until they finish. Shutdowns and handoffs wait for them.
+var pendingHooks hookCounter
+
+// hookCounter counts running hooks. Unlike a sync.WaitGroup, it
+// allows Add while Wait is running, since a connection may drop its
+// lock while a handoff is waiting.
+type hookCounter struct {
+	mu   sync.Mutex
+	n    int
+	idle *sync.Cond
+}
+
+// Add adds delta to the number of running hooks.
+func (c *hookCounter) Add(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += delta
+	if c.n < 0 {
+		panic("negative hookCounter")
+	}
+	if c.n == 0 && c.idle != nil {
+		c.idle.Broadcast()
+	}
+}
+
+// Done records that a hook has finished.
+func (c *hookCounter) Done() {
+	c.Add(-1)
+}
+
+// Wait blocks until no hooks are running.
+func (c *hookCounter) Wait() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = sync.NewCond(&c.mu)
+	}
+	for c.n > 0 {
+		c.idle.Wait()
+	}
+}
+
+// hookPath returns the configured hook executable for event, or "".
+func (cfg *daemonConfig) hookPath(event string) string {
+	switch event {
+	case hookPreExclusive:
+		return cfg.hookPreExclusive
+	case hookShared:
+		return cfg.hookShared
+	case hookPostRelease:
+		return cfg.hookPostRelease
+	}
+	panic("unknown hook event " + event)
+}
+
+// startHook runs the hook configured for event in the background and
+// returns a channel that receives the result of runHook. Canceling
+// ctx kills the hook.
+func startHook(ctx context.Context, logger *slog.Logger, cfg *daemonConfig, event string, hold HoldRecord) <-chan error {
+	c := make(chan error, 1)
+	go func() {
+		c <- runHook(ctx, logger, cfg, event, &hold)
+	}()
+	return c
+}
+
+// runHook runs the hook configured for event, if any, passing the
+// details of hold in the environment and logging its output to
+// logger. It returns errHookDelay if the hook exited with status
+// hookTempFail, or another error if the hook failed or ctx was
+// canceled.
+func runHook(ctx context.Context, logger *slog.Logger, cfg *daemonConfig, event string, hold *HoldRecord) error {
+	path := cfg.hookPath(event)
+	if path == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(withoutNotify(os.Environ()), hookEnv(event, hold)...)
+	// Collect the output in a file rather than a pipe. A hook may
+	// start a background process (such as restarting a service)
+	// that inherits its output, and with a pipe we would wait for
+	// that process to exit, too.
+	f, err := os.CreateTemp("", "perflock-hook-")
+	if err != nil {
+		return fmt.Errorf("%s hook %s: %w", event, path, err)
+	}
+	os.Remove(f.Name())
+	defer f.Close()
+	cmd.Stdout, cmd.Stderr = f, f
+	// Run the hook in its own process group, so if it times out we
+	// can kill everything it started.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hookWaitDelay
+	err = cmd.Run()
+	out, _ := io.ReadAll(io.NewSectionReader(f, 0, maxHookOutput))
+	if len(out) > 0 {
+		logger.Info("hook output", "event", "hook", "hook", event, "path", path, "output", strings.TrimRight(string(out), "\n"))
+	}
+	if err, ok := err.(*exec.ExitError); ok && err.ExitCode() == hookTempFail {
+		return errHookDelay
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %s: %w", event, path, err)
+	}
+	return nil
+}
+
+func hookEnv(event string, hold *HoldRecord) []string {
+	env := []string{
+		"PERFLOCK_EVENT=" + event,
+		"PERFLOCK_USER=" + hold.User,
+		"PERFLOCK_COMMAND=" + hold.Msg,
+		"PERFLOCK_MODE=" + hold.Mode(),
+	}
+	if hold.RealUser != "" {
+		env = append(env, "PERFLOCK_REAL_USER="+hold.RealUser)
+	}
+	for _, t := range []struct {
+		name string
+		t    time.Time
+	}{
+		{"PERFLOCK_ENQUEUED", hold.Enqueued},
+		{"PERFLOCK_ACQUIRED", hold.Acquired},
+		{"PERFLOCK_RELEASED", hold.Released},
+	} {
+		if !t.t.IsZero() {
+			env = append(env, t.name+"="+t.t.Format(time.RFC3339))
+		}
+	}
+	if hold.Governor != "" {
+		env = append(env, "PERFLOCK_GOVERNOR="+hold.Governor)
+	}
+	if hold.Turbo != "" {
+		env = append(env, "PERFLOCK_TURBO="+hold.Turbo)
+	}
+	if hold.CPUGovernor != "" {
+		env = append(env, "PERFLOCK_CPUGOV="+hold.CPUGovernor)
+	}
+	if hold.Throttles != 0 {
+		env = append(env, "PERFLOCK_THROTTLES="+strconv.Itoa(hold.Throttles))
+	}
+	if hold.Exited {
+		env = append(env, "PERFLOCK_EXIT_STATUS="+strconv.Itoa(hold.ExitStatus))
+	}
+	return env
+}
@@ -0,0 +1,115 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Limits on what a client can make the daemon do, so one misbehaving
+// client can't wedge the daemon for everyone.
+const (
+	// maxMessageSize is the largest message, including any gob
+	// type definitions, that the daemon accepts from a client.
+	maxMessageSize = 1 << 20
+
+	// handshakeTimeout is how long a new connection has to send
+	// its first message.
+	handshakeTimeout = 10 * time.Second
+
+	// messageTimeout is how long a client has to finish sending
+	// a message once it starts.
+	messageTimeout = 10 * time.Second
+
+	// writeTimeout is how long the daemon waits for a client to
+	// accept a response before giving up on the connection.
+	writeTimeout = 10 * time.Second
+
+	// defaultMaxConnsPerUser is the default limit on the number of
+	// connections from one user.
+	defaultMaxConnsPerUser = 64
+)
+
+var errMessageTooLarge = errors.New("message too large")
+
+// messageReader reads gob messages from a client connection,
+// enforcing maxMessageSize and messageTimeout for each message. Like
+// unbufferedReader, it is an io.ByteReader, so a gob.Decoder reading
+// from it doesn't read ahead of the current message.
+type messageReader struct {
+	r io.Reader
+	// c is the connection to set read deadlines on, or nil.
+	c net.Conn
+	// n is the number of bytes read of the current message.
+	n int
+}
+
+// next starts a new message.
+func (r *messageReader) next() {
+	r.n = 0
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if r.n >= maxMessageSize {
+		return 0, errMessageTooLarge
+	}
+	if len(p) > maxMessageSize-r.n {
+		p = p[:maxMessageSize-r.n]
+	}
+	n, err := r.r.Read(p)
+	if r.n == 0 && n > 0 && r.c != nil {
+		r.c.SetReadDeadline(time.Now().Add(messageTimeout))
+	}
+	r.n += n
+	return n, err
+}
+
+func (r *messageReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// readAction reads the next action from a client. dec must read from
+// r.
+func readAction(dec *gob.Decoder, r *messageReader) (PerfLockAction, error) {
+	r.next()
+	var msg PerfLockAction
+	err := dec.Decode(&msg)
+	if r.c != nil {
+		// Clients may wait indefinitely between messages.
+		r.c.SetReadDeadline(time.Time{})
+	}
+	if err == nil && msg.Action == nil {
+		err = errors.New("empty message")
+	}
+	return msg, err
+}
+
+// addConn counts a connection from user uid and returns the number of
+// connections from that user, including this one. Call dropConn when
+// the connection closes.
+func addConn(uid string) int {
+	servers.Lock()
+	defer servers.Unlock()
+	if servers.perUser == nil {
+		servers.perUser = make(map[string]int)
+	}
+	servers.perUser[uid]++
+	return servers.perUser[uid]
+}
+
+// dropConn stops counting a connection from user uid.
+func dropConn(uid string) {
+	servers.Lock()
+	defer servers.Unlock()
+	if servers.perUser[uid]--; servers.perUser[uid] <= 0 {
+		delete(servers.perUser, uid)
+	}
+}
@@ -4,7 +4,10 @@
 
 package main
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type PerfLock struct {
 	l sync.Mutex
@@ -17,20 +20,36 @@ type Locker struct {
 	shared bool
 	woken  bool
 
-	msg string
+	hold HoldRecord
 }
 
-func (l *PerfLock) Enqueue(shared, nonblocking bool, msg string) *Locker {
+// Enqueue adds a request for the lock described by hold to the
+// queue. hold.Acquired will be set when the lock is acquired.
+//
+// If hold.Demoted is set, the request is low priority: later normal
+// requests are queued ahead of it until it acquires the lock.
+func (l *PerfLock) Enqueue(hold HoldRecord, nonblocking bool) *Locker {
 	ch := make(chan bool, 1)
-	locker := &Locker{ch, ch, shared, false, msg}
+	locker := &Locker{ch, ch, hold.Shared, false, hold}
 
 	// Enqueue.
 	l.l.Lock()
 	defer l.l.Unlock()
-	l.setQ(append(l.q, locker))
+	i := len(l.q)
+	if !hold.Demoted {
+		// Go ahead of any waiting demoted requests.
+		for i > 0 && l.q[i-1].hold.Demoted && !l.q[i-1].woken {
+			i--
+		}
+	}
+	q := append(l.q, nil)
+	copy(q[i+1:], q[i:])
+	q[i] = locker
+	l.setQ(q)
 
 	if nonblocking && !locker.woken {
 		// Acquire failed. Dequeue.
+		copy(l.q[i:], l.q[i+1:])
 		l.setQ(l.q[:len(l.q)-1])
 		return nil
 	}
@@ -51,17 +70,70 @@ func (l *PerfLock) Dequeue(locker *Locker) {
 	panic("Dequeue of non-enqueued Locker")
 }
 
-func (l *PerfLock) Queue() []string {
-	var q []string
+// Queue returns the current and pending lock acquisitions, in queue
+// order. Current holders have a non-zero Acquired time.
+func (l *PerfLock) Queue() []HoldRecord {
+	var q []HoldRecord
 
 	l.l.Lock()
 	defer l.l.Unlock()
 	for _, locker := range l.q {
-		q = append(q, locker.msg)
+		q = append(q, locker.hold)
 	}
 	return q
 }
 
+// Woken returns whether locker has been granted the lock.
+func (l *PerfLock) Woken(locker *Locker) bool {
+	l.l.Lock()
+	defer l.l.Unlock()
+	return locker.woken
+}
+
+// Lockers returns the current and pending lock acquisitions, in
+// queue order.
+func (l *PerfLock) Lockers() []*Locker {
+	l.l.Lock()
+	defer l.l.Unlock()
+	return append([]*Locker(nil), l.q...)
+}
+
+// Restore adds a request handed off from another daemon to the end
+// of the queue. If woken is set, the request has already been
+// granted the lock and no value will be sent on the Locker's C. Once
+// the queue is restored, call Wake to grant the lock to any requests
+// that can now acquire it.
+func (l *PerfLock) Restore(hold HoldRecord, woken bool) *Locker {
+	if woken && hold.Acquired.IsZero() {
+		hold.Acquired = time.Now()
+	}
+	ch := make(chan bool, 1)
+	locker := &Locker{ch, ch, hold.Shared, woken, hold}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.q = append(l.q, locker)
+	return locker
+}
+
+// SetTuning records the CPU tuning fields of hold as the tuning
+// applied by the holder of locker, as reported by Queue.
+func (l *PerfLock) SetTuning(locker *Locker, hold HoldRecord) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	locker.hold.Governor = hold.Governor
+	locker.hold.Turbo = hold.Turbo
+	locker.hold.CPUGovernor = hold.CPUGovernor
+}
+
+// Wake grants the lock to any requests at the head of the queue that
+// can acquire it.
+func (l *PerfLock) Wake() {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.setQ(l.q)
+}
+
 func (l *PerfLock) setQ(q []*Locker) {
 	l.q = q
 	if len(q) == 0 {
@@ -71,6 +143,7 @@ func (l *PerfLock) setQ(q []*Locker) {
 	wake := func(locker *Locker) {
 		if locker.woken == false {
 			locker.woken = true
+			locker.hold.Acquired = time.Now()
 			locker.c <- true
 		}
 	}
@@ -0,0 +1,178 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// journalSocket is the socket of the systemd journal's native
+// protocol. See systemd-journald.service(8).
+const journalSocket = "/run/systemd/journal/socket"
+
+// setupLogging configures the daemon's structured logging. format is
+// one of "text", "json", "journal", or "auto", which uses journal if
+// the daemon's output is connected to the systemd journal and text
+// otherwise.
+func setupLogging(format string) error {
+	if format == "auto" {
+		format = "text"
+		if os.Getenv("JOURNAL_STREAM") != "" {
+			if _, err := os.Stat(journalSocket); err == nil {
+				format = "journal"
+			}
+		}
+	}
+
+	var h slog.Handler
+	switch format {
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, nil)
+	case "journal":
+		var err error
+		h, err = newJournalHandler(journalSocket)
+		if err != nil {
+			return err
+		}
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// journalHandler is a slog.Handler that sends records to the systemd
+// journal using its native protocol. Attributes become journal fields
+// prefixed with PERFLOCK_, such as PERFLOCK_CONN.
+type journalHandler struct {
+	conn *net.UnixConn
+	mu   *sync.Mutex
+
+	// fields are the encoded fields from WithAttrs.
+	fields []byte
+	// prefix is the field name prefix from WithGroup.
+	prefix string
+}
+
+func newJournalHandler(path string) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, mu: new(sync.Mutex), prefix: "PERFLOCK_"}, nil
+}
+
+func (h *journalHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", r.Message)
+	appendJournalField(&buf, "PRIORITY", journalPriority(r.Level))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", "perflock")
+	buf.Write(h.fields)
+	r.Attrs(func(a slog.Attr) bool {
+		h.appendAttr(&buf, h.prefix, a)
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var buf bytes.Buffer
+	buf.Write(h.fields)
+	for _, a := range attrs {
+		h.appendAttr(&buf, h.prefix, a)
+	}
+	h2.fields = buf.Bytes()
+	return &h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + journalFieldName(name) + "_"
+	return &h2
+}
+
+func (h *journalHandler) appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += journalFieldName(a.Key) + "_"
+		}
+		for _, a := range v.Group() {
+			h.appendAttr(buf, prefix, a)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	appendJournalField(buf, prefix+journalFieldName(a.Key), v.String())
+}
+
+// journalFieldName converts key to a valid journal field name, which
+// may only contain upper case letters, digits, and underscores.
+func journalFieldName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// appendJournalField appends a field in the journal's native
+// protocol encoding to buf.
+func appendJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	// Values containing newlines use a length-prefixed binary
+	// encoding.
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalPriority returns the syslog priority of level.
+func journalPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	}
+	return "7"
+}
@@ -27,8 +27,30 @@
 //     alias pl=perflock
 //     alias pls='perflock -shared'
 //
+// The daemon records each completed command in a history log. To see
+// what has run recently, use
+//
+//     perflock -history [-user user] [-since time]
+//
+// The daemon can run site-specific hook programs before granting a
+// lock and after releasing it, such as to stop and restart services
+// that would perturb benchmarks. Hooks receive the details of the
+// request in PERFLOCK_* environment variables. A pre-grant hook can
+// veto the grant by exiting with a non-zero status, or delay it by
+// exiting with status 75 (EX_TEMPFAIL), in which case the daemon
+// runs it again later.
+//
 // perflock depends on a locking daemon, which can be started with
-// perflock -daemon.
+// perflock -daemon. The daemon reads its configuration from
+// /etc/perflock.conf, if it exists, and re-reads it on SIGHUP. See
+// daemonConfig for the format of this file. On SIGUSR2, the daemon
+// re-executes its binary and hands its socket, clients, and lock
+// queue to the new process, so it can be upgraded without dropping
+// locks.
+//
+// Clients only trust a daemon running as root (or as the user given by
+// -daemon-user), so other users can't impersonate the daemon by
+// binding its socket first.
 package main
 
 import (
@@ -41,6 +63,9 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/aclements/perflock/internal/cpupower"
 )
 
 func main() {
@@ -49,35 +74,92 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "  %s [flags] command...\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -list\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -status\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -history [-user user] [-since time]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -daemon\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\n")
 		flag.PrintDefaults()
 	}
 	flagDaemon := flag.Bool("daemon", false, "start perflock daemon")
+	flagConfig := flag.String("config", defaultConfigFile, "with -daemon, read configuration from `path`")
 	flagList := flag.Bool("list", false, "print current and pending commands")
-	flagSocket := flag.String("socket", "/var/run/perflock.socket", "connect to socket `path`")
+	flagStatus := flag.Bool("status", false, "print the daemon's status and exit with status 0 if the lock is free,\n\t3 if it is held shared, or 4 if it is held exclusive")
+	flagHistory := flag.Bool("history", false, "print previously completed commands")
+	flagUser := flag.String("user", "", "with -history, print only commands run by `user`")
+	flagSince := flag.String("since", "", "with -history, print only commands completed since `time`\n\t(a duration such as 24h or a date such as 2006-01-02)")
+	flagHistoryFile := flag.String("history-file", defaultHistoryFile, "with -daemon, record completed commands to `path`")
+	flagStateFile := flag.String("state-file", defaultStateFile, "with -daemon, save CPU settings to restore after a crash in `path`")
+	flagLogFormat := flag.String("log-format", "auto", "with -daemon, write logs as `format` text, json, or journal\n\t(auto uses journal when running under systemd, otherwise text)")
+	flagSysfs := flag.String("sysfs", cpupower.SysfsRoot, "with -daemon, read and change CPU settings in the sysfs tree at `path`")
+	flagHTTP := flag.String("http", "", "with -daemon, serve a status page on `addr`ess (e.g., :8080 for localhost only, or 0.0.0.0:8080); anyone who can connect sees users' commands")
+	flagHookPreExclusive := flag.String("hook-pre-exclusive", "", "with -daemon, run `program` before granting an exclusive lock")
+	flagHookShared := flag.String("hook-shared", "", "with -daemon, run `program` before granting a shared lock")
+	flagHookPostRelease := flag.String("hook-post-release", "", "with -daemon, run `program` after releasing a lock")
+	flagSocket := flag.String("socket", defaultSocket, "connect to socket `path`")
+	flagDaemonUser := flag.String("daemon-user", "", "trust a daemon running as `user` (a name or UID) as well as root")
 	flagShared := flag.Bool("shared", false, "acquire lock in shared mode (default: exclusive mode)")
-	flagGovernor := &governorFlag{percent: 90}
-	flag.Var(flagGovernor, "governor", "set CPU frequency to `percent` between the min and max\n\twhile running command, or \"none\" for no adjustment")
+	flagGovernor := &governorFlag{}
+	flag.Var(flagGovernor, "governor", "set CPU frequency to `percent` between the min and max\n\twhile running command, or \"none\" for no adjustment\n\t(default: the daemon's configured setting, normally 90%)")
+	flagProfile := flag.String("profile", "", "apply the daemon's tuning profile `name` while running command")
+	flagCPUGov := flag.String("cpugov", "", "use the kernel's `name`d CPU scaling governor, such as performance,\n\twhile running command (default: the daemon's configured setting,\n\tnormally unchanged)")
+	flagTurbo := flag.String("turbo", "", "turn turbo boost `on` or off while running command\n\t(default: the daemon's configured setting, normally unchanged)")
 	flag.Parse()
 
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
 	if *flagDaemon {
 		if flag.NArg() > 0 {
 			flag.Usage()
 			os.Exit(2)
 		}
-		doDaemon(*flagSocket)
+		// Command-line flags override the configuration file.
+		overrides := func(cfg *daemonConfig) {
+			for _, f := range []struct {
+				name     string
+				dst, src *string
+			}{
+				{"socket", &cfg.socket, flagSocket},
+				{"history-file", &cfg.historyFile, flagHistoryFile},
+				{"state-file", &cfg.stateFile, flagStateFile},
+				{"http", &cfg.httpAddr, flagHTTP},
+				{"hook-pre-exclusive", &cfg.hookPreExclusive, flagHookPreExclusive},
+				{"hook-shared", &cfg.hookShared, flagHookShared},
+				{"hook-post-release", &cfg.hookPostRelease, flagHookPostRelease},
+			} {
+				if setFlags[f.name] {
+					*f.dst = *f.src
+				}
+			}
+			if setFlags["governor"] {
+				cfg.governor = flagGovernor.percent
+			}
+		}
+		if err := setupLogging(*flagLogFormat); err != nil {
+			log.Fatal(err)
+		}
+		cpupower.SysfsRoot = *flagSysfs
+		doDaemon(*flagConfig, overrides)
 		return
 	}
 
 	log.SetFlags(0)
 
+	var daemonUID string
+	if *flagDaemonUser != "" {
+		var err error
+		daemonUID, err = lookupUID(*flagDaemonUser)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if *flagList {
 		if flag.NArg() > 0 {
 			flag.Usage()
 			os.Exit(2)
 		}
-		c := NewClient(*flagSocket)
+		c := NewClient(*flagSocket, daemonUID)
 		list := c.List()
 		for _, l := range list {
 			fmt.Println(l)
@@ -85,32 +167,110 @@ func main() {
 		return
 	}
 
+	if *flagStatus {
+		if flag.NArg() > 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		c := NewClient(*flagSocket, daemonUID)
+		os.Exit(printStatus(os.Stdout, c.Status(), time.Now()))
+	}
+
+	if *flagHistory {
+		if flag.NArg() > 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		since, err := parseSince(*flagSince)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c := NewClient(*flagSocket, daemonUID)
+		for _, r := range c.History(*flagUser, since) {
+			fmt.Println(r.String())
+		}
+		return
+	}
+
 	cmd := flag.Args()
 	if len(cmd) == 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
-	c := NewClient(*flagSocket)
-	if !c.Acquire(*flagShared, true, shellEscapeList(cmd)) {
+	if *flagShared {
+		// Shared holders can't change CPU settings.
+		for _, name := range []string{"governor", "profile", "cpugov", "turbo"} {
+			if setFlags[name] {
+				fmt.Fprintf(os.Stderr, "-%s can't be used with -shared\n", name)
+				flag.Usage()
+				os.Exit(2)
+			}
+		}
+	}
+	turbo, err := parseTurbo(*flagTurbo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := NewClient(*flagSocket, daemonUID)
+	ok, err := c.Acquire(*flagShared, true, shellEscapeList(cmd))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
 		list := c.List()
-		fmt.Fprintf(os.Stderr, "Waiting for lock...\n")
+		if wait, ok := c.EstimateWait(*flagShared, shellEscapeList(cmd)); ok {
+			fmt.Fprintf(os.Stderr, "Waiting for lock (estimated wait %s)...\n", formatEstimate(wait))
+		} else {
+			fmt.Fprintf(os.Stderr, "Waiting for lock...\n")
+		}
 		for _, l := range list {
 			fmt.Fprintln(os.Stderr, l)
 		}
-		c.Acquire(*flagShared, false, shellEscapeList(cmd))
+		if _, err := c.Acquire(*flagShared, false, shellEscapeList(cmd)); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if !*flagShared && flagGovernor.percent >= 0 {
-		c.SetGovernor(flagGovernor.percent)
+	if !*flagShared {
+		// Failing to set the governor is only worth mentioning
+		// if the user asked for something specific.
+		var err error
+		switch {
+		case *flagProfile != "":
+			err = c.SetGovernor(ActionSetGovernor{Profile: *flagProfile, Turbo: turbo, CPUGovernor: *flagCPUGov})
+		case setFlags["governor"]:
+			// Send this even for -governor=none, since the
+			// daemon waits for it before handing the
+			// connection off to a new daemon.
+			err = c.SetGovernor(ActionSetGovernor{Percent: flagGovernor.percent, Turbo: turbo, CPUGovernor: *flagCPUGov})
+		default:
+			err1 := c.SetGovernor(ActionSetGovernor{Default: true, Turbo: turbo, CPUGovernor: *flagCPUGov})
+			if turbo != "" || *flagCPUGov != "" {
+				err = err1
+			}
+		}
+		if err != nil {
+			log.Printf("failed to set CPU governor: %v", err)
+		}
 	}
+	c.Watch()
 	ignoreSignals()
-	run(cmd)
+	status, err := run(cmd)
+	c.Release(err == nil, status)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(status)
 }
 
 type governorFlag struct {
 	percent int
+	set     bool
 }
 
 func (f *governorFlag) String() string {
+	if !f.set {
+		return ""
+	}
 	if f.percent < 0 {
 		return "none"
 	}
@@ -118,6 +278,7 @@ func (f *governorFlag) String() string {
 }
 
 func (f *governorFlag) Set(v string) error {
+	f.set = true
 	if v == "none" {
 		f.percent = -1
 	} else {
@@ -130,23 +291,24 @@ func (f *governorFlag) Set(v string) error {
 	return nil
 }
 
-// run executes args as a command and exits with the command's exit
-// status.
-func run(args []string) {
+// run executes args as a command and returns the command's exit
+// status. It returns an error if the command could not be started
+// or did not exit normally.
+func run(args []string) (int, error) {
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
 	err := cmd.Run()
 	switch err := err.(type) {
 	case nil:
-		os.Exit(0)
+		return 0, nil
 	case *exec.ExitError:
 		status := err.Sys().(syscall.WaitStatus)
 		if status.Exited() {
-			os.Exit(status.ExitStatus())
+			return status.ExitStatus(), nil
 		}
-		log.Fatal(err)
+		return 0, err
 	default:
-		log.Fatal(err)
+		return 0, err
 	}
 }
 
@@ -2,18 +2,30 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/aclements/perflock/internal/cpupower/cpupowertest"
 )
 
 const (
@@ -138,57 +150,1730 @@ func TestShared(t *testing.T) {
 	}
 }
 
-// funcname returns the function name of the caller.
-func funcname(skip int) string {
-	var pcs [1]uintptr
-	if runtime.Callers(skip+1, pcs[:]) != 1 {
-		return "UNKNOWN"
+func TestHistory(t *testing.T) {
+	t.Parallel()
+
+	socket := socketName(t)
+	mustStartDaemon(t, socket)
+
+	sleeper := mustStartSleeper(t, socket, "-shared")
+	sleeper.Wait()
+
+	out := mustRunPerflock(t, socket, "-history")
+	if !strings.Contains(out, os.Args[0]) || !strings.Contains(out, "[shared]") || !strings.Contains(out, "[exit 0]") {
+		t.Errorf("want completed sleeper in history, got:\n%s", out)
+	}
+
+	out = mustRunPerflock(t, socket, "-history", "-user", "nobody-"+funcname(1))
+	if out != "" {
+		t.Errorf("want no history for unknown user, got:\n%s", out)
 	}
-	fr, _ := runtime.CallersFrames(pcs[:]).Next()
-	return fr.Func.Name()
 }
 
-// socketName returns a unique socket name per test.
-func socketName(t *testing.T) string {
-	if runtime.GOOS == "linux" {
-		// Abstract sockets are automatically cleaned up when the process that
-		// created it (the daemon) exits. Avoids potential complications with the
-		// filesystem (read-only fs, ...) and leftovers from ctrl-c'ing the test
-		// prematurely.
-		return fmt.Sprintf("@perflock.%d.%s", os.Getpid(), funcname(2))
-	} else {
-		return filepath.Join(t.TempDir(), "perflock.socket")
+func TestHistoryDamage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	now := time.Now()
+	good, err := json.Marshal(HoldRecord{User: "alice", Msg: "before", Acquired: now, Released: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record, an over-long line, and a partial record left by
+	// a crash.
+	var log []byte
+	log = append(log, good...)
+	log = append(log, '\n', '"')
+	log = append(log, strings.Repeat("x", 2*maxHistoryLine)...)
+	log = append(log, "\"\n{\"User\":\"bo"...)
+	if err := os.WriteFile(path, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Append(&HoldRecord{User: "alice", Msg: "after", Acquired: now, Released: now}); err != nil {
+		t.Fatal(err)
+	}
+	hist, err := h.Query("", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, r := range hist {
+		msgs = append(msgs, r.Msg)
+	}
+	if got, want := strings.Join(msgs, ","), "before,after"; got != want {
+		t.Errorf("got records %s, want %s", got, want)
 	}
 }
 
-// mustStartSleeper starts a perflock client running a sleeper.
-func mustStartSleeper(t *testing.T, socket string, argv ...string) *exec.Cmd {
-	t.Helper()
-	cmd, err := startProcess(t, append(argv, "-socket="+socket, os.Args[0]), []string{"GO_TEST_MODE=perflock", "GO_TEST_PROGRAM_MODE=sleeper"})
+func TestRealUser(t *testing.T) {
+	h, err := OpenHistory(filepath.Join(t.TempDir(), "history"))
 	if err != nil {
-		t.Fatalf("could not start sleeper: %v", err)
+		t.Fatal(err)
+	}
+	now := time.Now()
+	r := HoldRecord{User: "root", RealUser: "alice", Msg: "make", Acquired: now, Released: now}
+	if got, want := r.Who(), "alice (as root)"; got != want {
+		t.Errorf("Who() = %q, want %q", got, want)
+	}
+	if err := h.Append(&r); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "root"} {
+		hist, err := h.Query(user, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hist) != 1 || hist[0].Who() != "alice (as root)" {
+			t.Errorf("Query(%q) = %v, want alice's record", user, hist)
+		}
 	}
-	return cmd
 }
 
-// mustStartDaemon starts a perflock daemon and wait for it to start listening on
-// the socket.
-func mustStartDaemon(t *testing.T, socket string) {
-	t.Helper()
-	_, err := startProcess(t, []string{"-socket=" + socket, "-daemon"}, []string{"GO_TEST_MODE=perflock"})
+func TestExclusiveHolds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := OpenHistory(path)
 	if err != nil {
-		t.Fatalf("could not start daemon: %v", err)
+		t.Fatal(err)
 	}
-	t.Logf("started daemon... waiting for it to become connectable")
-	{
-		ctx := context.Background()
-		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-		defer cancel()
-		if !waitForDaemon(t, ctx, socket) {
-			t.Fatalf("gave up waiting for daemon")
+	now := time.Now()
+	hold := func(user, realUser string, shared bool, ago time.Duration) *HoldRecord {
+		return &HoldRecord{User: user, RealUser: realUser, Shared: shared, Acquired: now.Add(-ago - time.Minute), Released: now.Add(-ago)}
+	}
+	// Written before any quota window is set.
+	if err := h.Append(hold("alice", "", false, 2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetQuotaWindow(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*HoldRecord{
+		hold("alice", "", true, time.Hour),
+		hold("root", "alice", false, time.Hour),
+		hold("bob", "", false, time.Hour),
+	} {
+		if err := h.Append(r); err != nil {
+			t.Fatal(err)
 		}
-		t.Logf("daemon started!")
 	}
+	if got := len(h.ExclusiveHolds("alice", now.Add(-24*time.Hour))); got != 2 {
+		t.Errorf("alice has %d exclusive holds in the last day, want 2", got)
+	}
+	if got := len(h.ExclusiveHolds("alice", now.Add(-90*time.Minute))); got != 1 {
+		t.Errorf("alice has %d exclusive holds in the last 90m, want 1", got)
+	}
+	if got := len(h.ExclusiveHolds("root", now.Add(-24*time.Hour))); got != 0 {
+		t.Errorf("root has %d exclusive holds in the last day, want 0 (they count against alice)", got)
+	}
+
+	// Shrinking the window prunes old holds as new ones arrive.
+	if err := h.SetQuotaWindow(30 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Append(hold("alice", "", false, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(h.ExclusiveHolds("alice", time.Time{})); got != 1 {
+		t.Errorf("alice has %d exclusive holds after shrinking the window, want 1", got)
+	}
+
+	// Reopening re-reads the log.
+	h2, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.SetQuotaWindow(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(h2.ExclusiveHolds("alice", now.Add(-24*time.Hour))); got != 3 {
+		t.Errorf("reopened log: alice has %d exclusive holds in the last day, want 3", got)
+	}
+}
+
+func TestProcRealUID(t *testing.T) {
+	if data, err := os.ReadFile("/proc/self/loginuid"); err != nil || strings.TrimSpace(string(data)) != "4294967295" {
+		t.Skip("requires a process without a login UID")
+	}
+	// The kernel may not report the environment of a process that
+	// is still starting, so wait for the shell to say it's running.
+	// It then waits for input that never comes.
+	cmd := exec.Command("sh", "-c", "echo; read x")
+	cmd.Env = append(os.Environ(), "SUDO_UID=1001")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	if _, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	// Only sudo, running as root, sets SUDO_UID, so a non-root
+	// client that sets it must not be believed.
+	if got := procRealUID(cmd.Process.Pid, "1000"); got != "" {
+		t.Errorf("procRealUID as uid 1000 = %q, want \"\"", got)
+	}
+	if got := procRealUID(cmd.Process.Pid, "0"); got != "1001" {
+		t.Errorf("procRealUID as root = %q, want \"1001\"", got)
+	}
+}
+
+func TestEstimateSchedule(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	durations := map[string]time.Duration{
+		"a": 10 * time.Minute,
+		"b": 5 * time.Minute,
+		"c": 20 * time.Minute,
+	}
+	estimate := func(h *HoldRecord) (time.Duration, bool) {
+		d, ok := durations[h.Msg]
+		return d, ok
+	}
+	q := []HoldRecord{
+		{Msg: "a", Acquired: now.Add(-4 * time.Minute)},
+		{Msg: "b", Shared: true},
+		{Msg: "c", Shared: true},
+		{Msg: "a"},
+		{Msg: "unknown"},
+		{Msg: "a"},
+	}
+	sched := estimateSchedule(q, now, estimate)
+	want := []struct{ start, end time.Duration }{
+		{-4 * time.Minute, 6 * time.Minute},
+		{6 * time.Minute, 11 * time.Minute},
+		{6 * time.Minute, 26 * time.Minute},
+		{26 * time.Minute, 36 * time.Minute},
+		{36 * time.Minute, -1},
+		{-1, -1},
+	}
+	at := func(t time.Time) time.Duration {
+		if t.IsZero() {
+			return -1
+		}
+		return t.Sub(now)
+	}
+	for i, w := range want {
+		if start, end := at(sched[i].start), at(sched[i].end); start != w.start || end != w.end {
+			t.Errorf("request %d (%s): got start %v end %v, want start %v end %v", i, q[i].Msg, start, end, w.start, w.end)
+		}
+	}
+}
+
+func TestWithoutNotify(t *testing.T) {
+	env := []string{"PATH=/bin", "NOTIFY_SOCKET=/run/systemd/notify", "WATCHDOG_USEC=30000000", "WATCHDOG_PID=1", "HOME=/"}
+	if got, want := withoutNotify(env), []string{"PATH=/bin", "HOME=/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("withoutNotify = %q, want %q", got, want)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	if err := healthCheck(time.Second); err != nil {
+		t.Errorf("idle daemon: %v", err)
+	}
+	acceptBusy.Store(time.Now().Add(-time.Minute).UnixNano())
+	defer acceptBusy.Store(0)
+	if err := healthCheck(time.Second); err == nil {
+		t.Errorf("stuck accept loop: got no error")
+	}
+}
+
+func TestEnqueuePosition(t *testing.T) {
+	now := time.Now()
+	q := []HoldRecord{
+		{Msg: "held", Demoted: true, Acquired: now},
+		{Msg: "normal"},
+		{Msg: "demoted 1", Demoted: true},
+		{Msg: "demoted 2", Demoted: true},
+	}
+	if got, want := enqueuePosition(q, HoldRecord{}), 2; got != want {
+		t.Errorf("normal request: got position %d, want %d", got, want)
+	}
+	if got, want := enqueuePosition(q, HoldRecord{Demoted: true}), 4; got != want {
+		t.Errorf("demoted request: got position %d, want %d", got, want)
+	}
+	if got, want := enqueuePosition(q[:1], HoldRecord{}), 1; got != want {
+		t.Errorf("behind held demoted request: got position %d, want %d", got, want)
+	}
+
+	// Check that this agrees with Enqueue.
+	var l PerfLock
+	for _, h := range q {
+		h.Acquired = time.Time{}
+		l.Enqueue(h, false)
+	}
+	l.Enqueue(HoldRecord{Msg: "new"}, false)
+	var order []string
+	for _, h := range l.Queue() {
+		order = append(order, h.Msg)
+	}
+	if got, want := strings.Join(order, ","), "held,normal,new,demoted 1,demoted 2"; got != want {
+		t.Errorf("Enqueue order %s, want %s", got, want)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	locker := theLock.Enqueue(HoldRecord{User: "gopher", Msg: "go test -bench .", Enqueued: time.Now()}, false)
+	defer theLock.Dequeue(locker)
+
+	w := httptest.NewRecorder()
+	dashboardHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"Busy", "gopher", "go test -bench .", "exclusive"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestDashboardAddr(t *testing.T) {
+	for addr, want := range map[string]string{
+		":8080":         "localhost:8080",
+		"0.0.0.0:8080":  "0.0.0.0:8080",
+		"[::1]:8080":    "[::1]:8080",
+		"perf-box:http": "perf-box:http",
+	} {
+		if got := dashboardAddr(addr); got != want {
+			t.Errorf("dashboardAddr(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestRecentHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < maxRecent+5; i++ {
+		at := now.Add(time.Duration(i-maxRecent) * time.Hour)
+		if err := h.Append(&HoldRecord{User: "alice", Msg: fmt.Sprint(i), Acquired: at, Released: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopening rebuilds the same window from the log.
+	h2, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []*History{h, h2} {
+		all := h.Recent(time.Time{})
+		if len(all) != maxRecent || all[0].Msg != fmt.Sprint(maxRecent+4) || all[maxRecent-1].Msg != "5" {
+			t.Errorf("Recent returned %d records from %v to %v, want %d newest first", len(all), all[0].Msg, all[len(all)-1].Msg, maxRecent)
+		}
+		if got := len(h.Recent(now.Add(-90 * time.Minute))); got != 6 {
+			t.Errorf("Recent in the last 90m returned %d records, want 6", got)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hooks.out")
+	writeScript := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	pre := writeScript("pre", `echo "$PERFLOCK_EVENT $PERFLOCK_MODE" >> `+out+`
+case "$PERFLOCK_COMMAND" in *veto*) exit 1;; esac
+`)
+	post := writeScript("post", `echo "$PERFLOCK_EVENT $PERFLOCK_MODE $PERFLOCK_EXIT_STATUS" >> `+out+"\n")
+
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-hook-pre-exclusive="+pre, "-hook-shared="+pre, "-hook-post-release="+post)
+
+	mustStartSleeper(t, socket).Wait()
+	mustStartSleeper(t, socket, "-shared").Wait()
+
+	// A failing pre-grant hook vetoes the acquisition.
+	cmd := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "true", "veto")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if msg, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(msg), "vetoed") {
+		t.Errorf("want vetoed acquisition, got err %v, output:\n%s", err, msg)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pre-exclusive exclusive\npost-release exclusive 0\nshared shared\npost-release shared 0\npre-exclusive exclusive\n"
+	if string(data) != want {
+		t.Errorf("got hook runs:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestHookCounter(t *testing.T) {
+	var c hookCounter
+	c.Add(1)
+	waited := make(chan bool)
+	go func() {
+		c.Wait()
+		close(waited)
+	}()
+	// Another hook may start while Wait is running.
+	c.Add(1)
+	c.Done()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned with a hook running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Done()
+	<-waited
+	c.Wait()
+}
+
+func TestHookBackground(t *testing.T) {
+	t.Parallel()
+
+	// A hook that starts a background process (for example,
+	// restarting a service) must not hold up the lock.
+	dir := t.TempDir()
+	pids := filepath.Join(dir, "pids")
+	hook := filepath.Join(dir, "hook")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nsleep 60 &\necho $! >> "+pids+"\necho started\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		data, _ := os.ReadFile(pids)
+		for _, f := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(f); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	})
+
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-hook-pre-exclusive="+hook, "-hook-post-release="+hook)
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		cmd := exec.CommandContext(ctx, os.Args[0], "-socket="+socket, daemonUser, "true")
+		cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+		msg, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			t.Fatalf("run %d: %v, output:\n%s", i, err, msg)
+		}
+	}
+}
+
+func TestHookAsync(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	hook := filepath.Join(dir, "hook")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\ncase \"$PERFLOCK_COMMAND\" in *slow*) touch "+started+"; sleep 60;; esac\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-hook-pre-exclusive="+hook)
+
+	// Disconnect while the pre-grant hook is running. The daemon
+	// should notice, kill the hook, and release the lock.
+	slow := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "true", "slow")
+	slow.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if err := slow.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, func() bool {
+		_, err := os.Stat(started)
+		return err == nil
+	}) {
+		t.Fatal("hook did not start")
+	}
+	slow.Process.Kill()
+	slow.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-socket="+socket, daemonUser, "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v, output:\n%s", err, msg)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	hook := filepath.Join(dir, "hook")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "perflock.conf")
+	if err := os.WriteFile(conf, []byte("hook-timeout 500ms\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-config="+conf, "-hook-pre-exclusive="+hook)
+
+	// A hook that runs too long is killed and vetoes the grant.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-socket="+socket, daemonUser, "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if msg, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(msg), "vetoed") {
+		t.Errorf("want vetoed acquisition, got err %v, output:\n%s", err, msg)
+	}
+}
+
+func TestSDNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 128)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "READY=1" {
+		t.Errorf("got notification %q, want %q", got, "READY=1")
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET: %v", err)
+	}
+}
+
+func TestJournalHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	h, err := newJournalHandler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("conn", 3, "user", "alice")
+	logger.Warn("acquiring lock twice", "event", "protocol-error", "output", "a\nb")
+
+	buf := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "MESSAGE=acquiring lock twice\n" +
+		"PRIORITY=4\n" +
+		"SYSLOG_IDENTIFIER=perflock\n" +
+		"PERFLOCK_CONN=3\n" +
+		"PERFLOCK_USER=alice\n" +
+		"PERFLOCK_EVENT=protocol-error\n" +
+		"PERFLOCK_OUTPUT\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got journal entry %q, want %q", got, want)
+	}
+}
+
+func TestSecondDaemon(t *testing.T) {
+	t.Parallel()
+
+	// Use a filesystem socket, since that's where a second daemon
+	// could otherwise steal the socket.
+	socket := filepath.Join(t.TempDir(), "perflock.socket")
+	mustStartDaemon(t, socket)
+
+	cmd := exec.Command(os.Args[0], "-socket="+socket, "-daemon", "-history-file=")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "already running") {
+		t.Errorf("want second daemon to fail, got err %v, output:\n%s", err, out)
+	}
+
+	// The first daemon should still be serving.
+	mustRunPerflock(t, socket, "-list")
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	socket := socketName(t)
+	daemon := mustStartDaemon(t, socket)
+
+	// Start a client that holds the lock for a while.
+	var stderr strings.Builder
+	client := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=none", "sleep", "2")
+	client.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	client.Stderr = &stderr
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Process.Kill()
+	if !waitFor(t, func() bool { return strings.Contains(mustRunPerflock(t, socket, "-list"), "sleep 2") }) {
+		t.Fatal("client never acquired the lock")
+	}
+
+	if err := daemon.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Wait(); err != nil {
+		t.Errorf("daemon exited with %v", err)
+	}
+
+	// The client should have been notified.
+	client.Wait()
+	if !strings.Contains(stderr.String(), "shutting down") {
+		t.Errorf("client was not notified of shutdown; stderr:\n%s", stderr.String())
+	}
+}
+
+func TestListPID(t *testing.T) {
+	t.Parallel()
+
+	socket := socketName(t)
+	mustStartDaemon(t, socket)
+
+	client := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=none", "sleep", "2")
+	client.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Wait()
+	defer client.Process.Kill()
+	want := fmt.Sprintf("[pid %d", client.Process.Pid)
+	if !waitFor(t, func() bool { return strings.Contains(mustRunPerflock(t, socket, "-list"), want) }) {
+		t.Fatalf("-list never showed %q", want)
+	}
+}
+
+func TestProcessAlive(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	p, err := openProcess(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if !p.alive() {
+		t.Errorf("running process is not alive")
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if p.alive() {
+		t.Errorf("exited process is alive")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+
+	socket := socketName(t)
+	mustStartDaemon(t, socket)
+
+	status := func() (string, int) {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-status")
+		cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+		out, err := cmd.Output()
+		if err != nil {
+			var ee *exec.ExitError
+			if !errors.As(err, &ee) {
+				t.Fatal(err)
+			}
+		}
+		return string(out), cmd.ProcessState.ExitCode()
+	}
+
+	out, code := status()
+	if code != statusFree || !strings.Contains(out, "lock: free") || !strings.Contains(out, "socket: "+socket) {
+		t.Errorf("want free lock and exit status %d, got %d:\n%s", statusFree, code, out)
+	}
+
+	for _, test := range []struct {
+		mode string
+		code int
+	}{{"shared", statusShared}, {"exclusive", statusExclusive}} {
+		args := []string{"-socket=" + socket, "-shared", "sleep", "10"}
+		if test.mode == "exclusive" {
+			args[1] = "-governor=none"
+		}
+		holder := exec.Command(os.Args[0], args...)
+		holder.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+		if err := holder.Start(); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool {
+			out, code = status()
+			return code == test.code
+		})
+		if code != test.code || !strings.Contains(out, "lock: "+test.mode) || !strings.Contains(out, "sleep 10") {
+			t.Errorf("want %s lock and exit status %d, got %d:\n%s", test.mode, test.code, code, out)
+		}
+		holder.Process.Kill()
+		holder.Wait()
+	}
+}
+
+func TestTrustDaemon(t *testing.T) {
+	for _, test := range []struct {
+		uid, daemonUID string
+		want           bool
+	}{
+		{"0", "", true},
+		{"1000", "", false},
+		{"65534", "", false},
+		{"65534", "65534", true},
+		{"65534", "123", false},
+	} {
+		if got := trustDaemon(test.uid, test.daemonUID); got != test.want {
+			t.Errorf("trustDaemon(%q, %q) = %v, want %v", test.uid, test.daemonUID, got, test.want)
+		}
+	}
+}
+
+func TestUntrustedDaemon(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must be root to run a daemon as another user")
+	}
+	t.Parallel()
+
+	// Run a daemon as nobody, as if an unprivileged user had
+	// bound the socket first. nobody may not be able to reach the
+	// test binary, so make a copy it can run.
+	dir, err := os.MkdirTemp("", "perflock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "perflock.test")
+	data, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bin, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	daemon := exec.Command(bin, "-daemon", "-socket="+socket, "-config=/nonexistent", "-history-file=", "-state-file=")
+	daemon.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	daemon.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	if err := daemon.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Wait()
+	defer daemon.Process.Kill()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if !waitForDaemon(t, ctx, socket) {
+		t.Skip("daemon could not start as nobody")
+	}
+
+	cmd := exec.Command(os.Args[0], "-socket="+socket, "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "refusing to trust") {
+		t.Errorf("want client to refuse daemon, got err %v, output:\n%s", err, out)
+	}
+
+	cmd = exec.Command(os.Args[0], "-socket="+socket, "-daemon-user=65534", "-governor=none", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("want client to trust -daemon-user, got err %v, output:\n%s", err, out)
+	}
+}
+
+func TestHandoffFDs(t *testing.T) {
+	pair, err := socketpair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := func(fd int) *net.UnixConn {
+		f := os.NewFile(uintptr(fd), "handoff")
+		defer f.Close()
+		c, err := net.FileConn(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c.(*net.UnixConn)
+	}
+	ours, theirs := conn(pair[0]), conn(pair[1])
+
+	// More than fit in one message.
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fds := make([]int, 2*handoffMaxFDs+10)
+	for i := range fds {
+		fds[i] = int(f.Fd())
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- sendFDs(ours, fds) }()
+	got, err := receiveFDs(theirs, len(fds))
+	for _, fd := range got {
+		syscall.Close(fd)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(fds) {
+		t.Errorf("received %d file descriptors, want %d", len(got), len(fds))
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+
+	// Use a filesystem socket so the daemon has a PID file.
+	socket := filepath.Join(t.TempDir(), "perflock.socket")
+	daemon := mustStartDaemon(t, socket)
+
+	// Start a client that holds the lock until we close its stdin
+	// and one that waits for it.
+	var holderErr, waiterErr strings.Builder
+	holder := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=none", "cat")
+	holder.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	holder.Stderr = &holderErr
+	release, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Process.Kill()
+	waiter := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-shared", "true")
+	waiter.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	waiter.Stderr = &waiterErr
+	var list string
+	if !waitFor(t, func() bool {
+		list = mustRunPerflock(t, socket, "-list")
+		if waiter.Process == nil && strings.Contains(list, "\tcat") {
+			if err := waiter.Start(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return strings.Contains(list, "true [shared]")
+	}) {
+		t.Fatalf("clients never queued; -list:\n%s", list)
+	}
+	if waiter.Process != nil {
+		defer waiter.Process.Kill()
+	}
+
+	// Upgrade the daemon. The old daemon should exit and leave a
+	// new one running.
+	upgradeDaemon(t, daemon, socket)
+
+	// Both clients should run to completion under the new daemon.
+	release.Close()
+	if err := holder.Wait(); err != nil {
+		t.Errorf("holder failed: %v\n%s", err, holderErr.String())
+	}
+	if err := waiter.Wait(); err != nil {
+		t.Errorf("waiter failed: %v\n%s", err, waiterErr.String())
+	}
+	if out := holderErr.String() + waiterErr.String(); out != "" && !strings.Contains(out, "Waiting for lock") {
+		t.Errorf("unexpected client output:\n%s", out)
+	}
+	out := mustRunPerflock(t, socket, "-history")
+	if !strings.Contains(out, "\tcat") || !strings.Contains(out, "true") {
+		t.Errorf("want both clients in history, got:\n%s", out)
+	}
+}
+
+// upgradeDaemon asks daemon to hand off to a new daemon process,
+// waits for the old daemon to exit, and arranges to kill the new one
+// at the end of the test. daemon must listen on a filesystem socket,
+// so it has a PID file.
+func upgradeDaemon(t *testing.T, daemon *exec.Cmd, socket string) {
+	t.Helper()
+	old, err := openProcess(daemon.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.close()
+	if err := daemon.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	// Don't Wait for the old daemon: that would close the output
+	// pipe the new daemon inherited from it.
+	if !waitFor(t, func() bool { return !old.alive() }) {
+		t.Fatal("old daemon did not exit")
+	}
+	data, err := os.ReadFile(socket + ".pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid == daemon.Process.Pid {
+		t.Fatalf("PID file contains %q; want new daemon's PID", data)
+	}
+	t.Cleanup(func() {
+		// The new daemon isn't our child, so wait for it to
+		// exit by watching it.
+		p, err := openProcess(pid)
+		if err != nil {
+			return
+		}
+		defer p.close()
+		syscall.Kill(pid, syscall.SIGKILL)
+		waitFor(t, func() bool { return !p.alive() })
+	})
+}
+
+func TestParseConfig(t *testing.T) {
+	const conf = `
+# Site configuration.
+socket-mode 0770
+governor 80%
+max-hold 2h
+hook pre-exclusive /usr/local/bin/stop-monitoring
+hook-timeout 1m
+history-file none
+profile quiet governor=none
+profile bench governor=50% turbo=off cpugov=performance
+max-conns-per-user 8
+turbo off
+cpugov userspace
+`
+	cfg, err := loadConfig("/nonexistent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.parse("perflock.conf", strings.NewReader(conf)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.socket != defaultSocket || cfg.socketMode != 0770 || cfg.governor != 80 || cfg.maxHold != 2*time.Hour ||
+		cfg.hookPreExclusive != "/usr/local/bin/stop-monitoring" || cfg.hookTimeout != time.Minute || cfg.historyFile != "" || cfg.maxConnsPerUser != 8 || cfg.turbo != "off" ||
+		cfg.cpuGovernor != "userspace" {
+		t.Errorf("parsed config incorrectly: %+v", cfg)
+	}
+	if p := cfg.profiles["quiet"]; p == nil || p.governor != -1 {
+		t.Errorf("bad profile quiet: %+v", p)
+	}
+	if p := cfg.profiles["bench"]; p == nil || p.governor != 50 || p.turbo != "off" || p.cpuGovernor != "performance" {
+		t.Errorf("bad profile bench: %+v", p)
+	}
+
+	for _, bad := range []string{"frob 1", "governor fast", "socket-mode 999", "max-hold 1", "hook sometimes /bin/true", "profile p turbo", "max-conns-per-user -1", "turbo maybe"} {
+		if err := defaultConfig().parse("perflock.conf", strings.NewReader(bad)); err == nil {
+			t.Errorf("parsing %q: want error", bad)
+		}
+	}
+}
+
+func TestVersion0Client(t *testing.T) {
+	t.Parallel()
+
+	socket := socketName(t)
+	mustStartDaemon(t, socket)
+
+	// Clients that predate protocol versions expect a bool reply to
+	// ActionAcquire.
+	acquire := func(nonblocking bool) bool {
+		c, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := gob.NewEncoder(c).Encode(PerfLockAction{ActionAcquire{NonBlocking: nonblocking, Msg: "old client"}}); err != nil {
+			t.Fatal(err)
+		}
+		var ok bool
+		if err := gob.NewDecoder(c).Decode(&ok); err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !acquire(false) {
+		t.Fatal("blocking acquire failed")
+	}
+	if acquire(true) {
+		t.Fatal("non-blocking acquire succeeded while lock is held")
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(PerfLockAction{ActionList{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(PerfLockAction{ActionAcquire{Msg: strings.Repeat("x", maxMessageSize)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &messageReader{r: &buf}
+	dec := gob.NewDecoder(r)
+	if msg, err := readAction(dec, r); err != nil {
+		t.Fatalf("reading small message: %v", err)
+	} else if _, ok := msg.Action.(ActionList); !ok {
+		t.Fatalf("got %#v, want ActionList", msg.Action)
+	}
+	if _, err := readAction(dec, r); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("reading large message: got %v, want %v", err, errMessageTooLarge)
+	}
+}
+
+func FuzzReadAction(f *testing.F) {
+	for _, action := range []interface{}{
+		ActionAcquire{Shared: true, Msg: "go test", Handoff: true, Version: protocolVersion},
+		ActionList{},
+		ActionEstimateWait{Msg: "go test"},
+		ActionSetGovernor{Percent: 90},
+		ActionRelease{Exited: true, ExitStatus: 1},
+		ActionHistory{User: "alice", Since: time.Unix(1e9, 0)},
+		ActionStatus{},
+		ActionReset{},
+	} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(PerfLockAction{action}); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := &messageReader{r: bytes.NewReader(data)}
+		dec := gob.NewDecoder(r)
+		for {
+			if _, err := readAction(dec, r); err != nil {
+				break
+			}
+		}
+	})
+}
+
+func TestGovernor(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	layout := cpupowertest.ACPI
+	if err := cpupowertest.Build(root, layout); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	// 60% is 1920 MHz, so the daemon should pick the nearest
+	// available frequency, 2000 MHz, for each domain.
+	out := mustRunPerflock(t, socket, "-governor=60%", "grep", "-h", ".",
+		filepath.Join(cpupowertest.CPUFreqDir(root, 0), "scaling_min_freq"),
+		filepath.Join(cpupowertest.CPUFreqDir(root, 2), "scaling_max_freq"))
+	if got, want := strings.Fields(out), []string{"2000000", "2000000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("while holding lock, got frequencies %v, want %v", got, want)
+	}
+
+	// The daemon restores the original settings once it processes
+	// the release, which may be after the client exits.
+	for _, cpu := range []int{0, 2} {
+		var min, max int
+		var err error
+		if !waitFor(t, func() bool {
+			min, max, err = cpupowertest.ReadRange(root, cpu)
+			return err == nil && min == layout.Min && max == layout.Max
+		}) {
+			t.Errorf("after release, cpu%d range is %d-%d (err %v), want %d-%d", cpu, min, max, err, layout.Min, layout.Max)
+		}
+	}
+}
+
+func TestPStateGovernor(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	layout := cpupowertest.PState
+	if err := cpupowertest.Build(root, layout); err != nil {
+		t.Fatal(err)
+	}
+	// An administrator has capped performance, which would
+	// otherwise keep the daemon from pinning the frequency.
+	pstate := filepath.Join(root, "devices/system/cpu/intel_pstate")
+	if err := os.WriteFile(filepath.Join(pstate, "max_perf_pct"), []byte("50\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	out := mustRunPerflock(t, socket, "-governor=100%", "grep", "-h", ".",
+		filepath.Join(pstate, "max_perf_pct"),
+		filepath.Join(cpupowertest.CPUFreqDir(root, 3), "scaling_min_freq"),
+		filepath.Join(cpupowertest.CPUFreqDir(root, 3), "energy_performance_preference"))
+	if got, want := strings.Fields(out), []string{"100", "3600000", "performance"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("while holding lock, got max_perf_pct, frequency, and EPP %v, want %v", got, want)
+	}
+
+	// The daemon restores the original settings once it processes
+	// the release.
+	wantMin := layout.Min * 100 / layout.Max
+	var min, max int
+	var epp string
+	var err, err1 error
+	if !waitFor(t, func() bool {
+		min, max, err = cpupowertest.PerfPct(root)
+		epp, err1 = cpupowertest.EPP(root, 3)
+		return err == nil && err1 == nil && min == wantMin && max == 50 && epp == cpupowertest.EPPs[2]
+	}) {
+		t.Fatalf("after release, perf pct = %d-%d (err %v) and EPP = %q (err %v), want %d-50 and %q", min, max, err, epp, err1, wantMin, cpupowertest.EPPs[2])
+	}
+
+	out = mustRunPerflock(t, socket, "-status")
+	if !strings.Contains(out, "cpufreq driver: intel_pstate (active mode)") || !strings.Contains(out, "EPP balance_performance") {
+		t.Errorf("want driver and EPP in status, got:\n%s", out)
+	}
+
+	// The daemon leaves the EPP alone if the domain doesn't
+	// offer "performance".
+	avail := filepath.Join(cpupowertest.CPUFreqDir(root, 3), "energy_performance_available_preferences")
+	if err := os.WriteFile(avail, []byte("balance_performance balance_power power\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out = mustRunPerflock(t, socket, "-governor=100%", "grep", "-h", ".",
+		filepath.Join(cpupowertest.CPUFreqDir(root, 3), "energy_performance_preference"))
+	if got := strings.TrimSpace(out); got != cpupowertest.EPPs[2] {
+		t.Errorf("with no performance EPP available, EPP is %q, want %q", got, cpupowertest.EPPs[2])
+	}
+}
+
+func TestAMDPStateMode(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := cpupowertest.Build(root, cpupowertest.AMD); err != nil {
+		t.Fatal(err)
+	}
+	status := filepath.Join(root, "devices/system/cpu/amd_pstate/status")
+	if err := os.WriteFile(status, []byte("passive\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	// Pinning the frequency switches amd-pstate to guided mode.
+	out := mustRunPerflock(t, socket, "-governor=100%", "cat", status)
+	if got := strings.TrimSpace(out); got != "guided" {
+		t.Errorf("while holding lock, amd-pstate status is %q, want guided", got)
+	}
+	// The daemon switches back once it processes the release.
+	var got string
+	var err error
+	if !waitFor(t, func() bool {
+		got, err = cpupowertest.PStateStatus(root)
+		return err == nil && got == "passive"
+	}) {
+		t.Errorf("after release, amd-pstate status is %q (err %v), want passive", got, err)
+	}
+
+	// Other settings leave the mode alone.
+	out = mustRunPerflock(t, socket, "-governor=none", "-turbo=off", "cat", status)
+	if got := strings.TrimSpace(out); got != "passive" {
+		t.Errorf("without -governor, amd-pstate status is %q, want passive", got)
+	}
+}
+
+func TestFrequencyReport(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := cpupowertest.Build(root, cpupowertest.ACPI); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	run := func() string {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=60%", "true")
+		cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("perflock failed: %v\n%s", err, out)
+		}
+		return string(out)
+	}
+
+	// The simulated CPUs keep running at 2400 MHz, ignoring the
+	// 2000 MHz target.
+	out := run()
+	if !strings.Contains(out, "CPU frequency during run on CPUs 0-3: 2400-2400 MHz, mean 2400 MHz (target 2000 MHz, from scaling_cur_freq)") ||
+		!strings.Contains(out, "warning: policy0 (CPUs 0-1) averaged 2400 MHz, 20% above its 2000 MHz target") {
+		t.Errorf("want frequency report with warning, got:\n%s", out)
+	}
+
+	for _, cpu := range []int{0, 2} {
+		if err := cpupowertest.SetCurFreq(root, cpu, 2000000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out = run()
+	if !strings.Contains(out, "mean 2000 MHz (target 2000 MHz") || strings.Contains(out, "warning") {
+		t.Errorf("want frequency report without warning, got:\n%s", out)
+	}
+}
+
+func TestThermalThrottling(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := cpupowertest.Build(root, cpupowertest.PState); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	// The command heats up the CPUs enough to throttle CPU 1's
+	// core three times and the package twice.
+	cpus := filepath.Join(root, "devices/system/cpu")
+	script := fmt.Sprintf("echo 3 > %[1]s/cpu1/thermal_throttle/core_throttle_count; "+
+		"echo 2 > %[1]s/cpu0/thermal_throttle/package_throttle_count; "+
+		"echo 2 > %[1]s/cpu1/thermal_throttle/package_throttle_count; "+
+		"echo 95000 > %[2]s/temp", cpus, cpupowertest.ThermalZoneDir(root, 0))
+	cmd := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=none", "sh", "-c", script)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("perflock failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "WARNING: CPUs were thermally throttled during this run (3 core throttling events on CPUs 1, 2 package throttling events)") ||
+		!strings.Contains(string(out), "temperatures: x86_pkg_temp 45°C -> 95°C") {
+		t.Errorf("want throttling warning, got:\n%s", out)
+	}
+
+	// A run without throttling has no warning.
+	cmd = exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=none", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if out, err := cmd.CombinedOutput(); err != nil || len(out) != 0 {
+		t.Errorf("want quiet run, got err %v, output:\n%s", err, out)
+	}
+
+	hist := mustRunPerflock(t, socket, "-history")
+	if lines := strings.Split(strings.TrimSpace(hist), "\n"); len(lines) != 2 || !strings.Contains(lines[0], "[throttled 5]") || strings.Contains(lines[1], "throttled") {
+		t.Errorf("want first hold throttled in history, got:\n%s", hist)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	layout := cpupowertest.ACPI
+	if err := cpupowertest.Build(root, layout); err != nil {
+		t.Fatal(err)
+	}
+	pdir := cpupowertest.CPUFreqDir(root, 2)
+	for _, name := range []string{"scaling_min_freq", "scaling_max_freq"} {
+		if err := os.WriteFile(filepath.Join(pdir, name), []byte("2000000\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A daemon that crashed while a client had pinned policy2
+	// leaves its original range behind.
+	state := filepath.Join(t.TempDir(), "state.json")
+	data := fmt.Sprintf(`{"Saved": [{"Conn": 1, "Ranges": [{"Domain": %q, "Min": %d, "Max": %d}]}]}`, pdir, layout.Min, layout.Max)
+	if err := os.WriteFile(state, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustStartDaemon(t, socketName(t), "-sysfs="+root, "-state-file="+state)
+	if min, max, err := cpupowertest.ReadRange(root, 2); err != nil || min != layout.Min || max != layout.Max {
+		t.Errorf("after restart, cpu2 range is %d-%d (err %v), want %d-%d", min, max, err, layout.Min, layout.Max)
+	}
+}
+
+func TestCorruptStateFile(t *testing.T) {
+	t.Parallel()
+
+	// A corrupt state file is set aside rather than keeping the
+	// daemon from starting.
+	bad := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(bad, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-state-file="+bad)
+	mustRunPerflock(t, socket, "-governor=none", "true")
+	if data, err := os.ReadFile(bad + ".corrupt"); err != nil || string(data) != "{" {
+		t.Errorf("corrupt state file not set aside: %q, %v", data, err)
+	}
+}
+
+func TestLegacyStateFile(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	layout := cpupowertest.ACPI
+	if err := cpupowertest.Build(root, layout); err != nil {
+		t.Fatal(err)
+	}
+	pdir := cpupowertest.CPUFreqDir(root, 3)
+	for _, name := range []string{"scaling_min_freq", "scaling_max_freq"} {
+		if err := os.WriteFile(filepath.Join(pdir, name), []byte("2000000\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Older daemons recorded each CPU's cpufreq directory rather
+	// than its policy directory.
+	state := filepath.Join(t.TempDir(), "state.json")
+	data := fmt.Sprintf(`{"Saved": [{"Conn": 1, "Ranges": [{"Domain": %q, "Min": %d, "Max": %d}]}]}`, pdir, layout.Min, layout.Max)
+	if err := os.WriteFile(state, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root, "-state-file="+state)
+
+	if min, max, err := cpupowertest.ReadRange(root, 2); err != nil || min != layout.Min || max != layout.Max {
+		t.Errorf("after restart, cpu2 range is %d-%d (err %v), want %d-%d", min, max, err, layout.Min, layout.Max)
+	}
+	out := mustRunPerflock(t, socket, "-status")
+	if !strings.Contains(out, "policy2 (CPUs 2-3): 1200-2400 MHz") || strings.Contains(out, "pending restore") {
+		t.Errorf("want restored policy2 in status, got:\n%s", out)
+	}
+}
+
+func TestFormatCPUs(t *testing.T) {
+	for _, test := range []struct {
+		cpus []int
+		want string
+	}{
+		{nil, ""},
+		{[]int{0}, "0"},
+		{[]int{0, 1, 2, 3}, "0-3"},
+		{[]int{0, 2, 3, 4, 8}, "0,2-4,8"},
+	} {
+		if got := formatCPUs(test.cpus); got != test.want {
+			t.Errorf("formatCPUs(%v) = %q, want %q", test.cpus, got, test.want)
+		}
+	}
+}
+
+func TestFrequencyReportUpgrade(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := cpupowertest.Build(root, cpupowertest.PState); err != nil {
+		t.Fatal(err)
+	}
+	// CPU 3 can't run as fast as the others, so it gets a
+	// different target.
+	if err := os.WriteFile(filepath.Join(cpupowertest.CPUFreqDir(root, 3), "cpuinfo_max_freq"), []byte("2000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for cpu, freq := range []int{3000000, 3000000, 3000000, 2000000} {
+		if err := cpupowertest.SetCurFreq(root, cpu, freq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socket := filepath.Join(t.TempDir(), "perflock.socket")
+	daemon := mustStartDaemon(t, socket, "-sysfs="+root)
+
+	var stderr strings.Builder
+	client := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=100%", "sleep", "4")
+	client.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	client.Stderr = &stderr
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Process.Kill()
+	if !waitFor(t, func() bool {
+		min, _, err := cpupowertest.ReadRange(root, 0)
+		return err == nil && min == 3600000
+	}) {
+		t.Fatal("client never pinned the frequency")
+	}
+	// Let the daemon take a sample, then change the frequency and
+	// hand off. The report should cover samples from both daemons.
+	time.Sleep(freqSampleInterval + freqSampleInterval/2)
+	for cpu := 0; cpu < 3; cpu++ {
+		if err := cpupowertest.SetCurFreq(root, cpu, 3600000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upgradeDaemon(t, daemon, socket)
+
+	if err := client.Wait(); err != nil {
+		t.Fatalf("client failed: %v\n%s", err, stderr.String())
+	}
+	for _, want := range []string{
+		"CPU frequency during run on CPUs 0-2: 3000-3600 MHz",
+		"(target 3600 MHz, from scaling_cur_freq)",
+		"CPU frequency during run on CPUs 3: 2000-2000 MHz, mean 2000 MHz (target 2000 MHz, from scaling_cur_freq)",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("want %q in report, got:\n%s", want, stderr.String())
+		}
+	}
+}
+
+func TestSharedTune(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	layout := cpupowertest.ACPI
+	if err := cpupowertest.Build(root, layout); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	// The perflock command never tunes under a shared lock, so
+	// speak the protocol directly.
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	enc, dec := gob.NewEncoder(c), gob.NewDecoder(c)
+	if err := enc.Encode(PerfLockAction{ActionAcquire{Shared: true, Msg: "shared", Version: protocolVersion}}); err != nil {
+		t.Fatal(err)
+	}
+	var resp AcquireResponse
+	if err := dec.Decode(&resp); err != nil || !resp.Acquired {
+		t.Fatalf("acquiring shared lock: %+v, %v", resp, err)
+	}
+	if err := enc.Encode(PerfLockAction{ActionSetGovernor{Percent: 50}}); err != nil {
+		t.Fatal(err)
+	}
+	var errString string
+	if err := dec.Decode(&errString); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errString, "shared lock") {
+		t.Errorf("want shared lock error, got %q", errString)
+	}
+	if min, max, err := cpupowertest.ReadRange(root, 0); err != nil || min != layout.Min || max != layout.Max {
+		t.Errorf("cpu0 range is %d-%d (err %v), want %d-%d", min, max, err, layout.Min, layout.Max)
+	}
+}
+
+func TestSharedFlags(t *testing.T) {
+	t.Parallel()
+
+	// The client rejects these before connecting.
+	socket := filepath.Join(t.TempDir(), "perflock.socket")
+	for _, flag := range []string{"-governor=50%", "-governor=none", "-profile=quiet", "-cpugov=performance", "-turbo=off"} {
+		cmd := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-shared", flag, "true")
+		cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+		out, err := cmd.CombinedOutput()
+		if code := cmd.ProcessState.ExitCode(); code != 2 || !strings.Contains(string(out), "can't be used with -shared") {
+			t.Errorf("-shared %s: got exit status %d (err %v), want 2 and a usage error; output:\n%s", flag, code, err, out)
+		}
+	}
+}
+
+func TestTurbo(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := cpupowertest.Build(root, cpupowertest.ACPI); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	out := mustRunPerflock(t, socket, "-governor=none", "-turbo=off", "grep", "-h", ".",
+		filepath.Join(root, "devices/system/cpu/cpufreq/boost"))
+	if got := strings.TrimSpace(out); got != "0" {
+		t.Errorf("while holding lock, boost is %q, want 0", got)
+	}
+
+	// The daemon re-enables turbo boost once it processes the
+	// release.
+	var enabled bool
+	var err error
+	if !waitFor(t, func() bool {
+		enabled, err = cpupowertest.TurboEnabled(root, 0)
+		return err == nil && enabled
+	}) {
+		t.Fatalf("after release, turbo enabled = %v (err %v), want true", enabled, err)
+	}
+
+	out = mustRunPerflock(t, socket, "-history")
+	if !strings.Contains(out, "[turbo off]") {
+		t.Errorf("want turbo setting in history, got:\n%s", out)
+	}
+}
+
+func TestCPUGovernor(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := cpupowertest.Build(root, cpupowertest.ACPI); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-sysfs="+root)
+
+	out := mustRunPerflock(t, socket, "-governor=none", "-cpugov=performance", "grep", "-h", ".",
+		filepath.Join(cpupowertest.CPUFreqDir(root, 0), "scaling_governor"),
+		filepath.Join(cpupowertest.CPUFreqDir(root, 2), "scaling_governor"))
+	if got, want := strings.Fields(out), []string{"performance", "performance"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("while holding lock, got governors %v, want %v", got, want)
+	}
+
+	// The daemon restores the original governor once it processes
+	// the release.
+	var gov string
+	var err error
+	if !waitFor(t, func() bool {
+		gov, err = cpupowertest.Governor(root, 2)
+		return err == nil && gov == "schedutil"
+	}) {
+		t.Fatalf("after release, governor is %q (err %v), want schedutil", gov, err)
+	}
+
+	// Governors the host doesn't have are rejected.
+	cmd := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=none", "-cpugov=turbo", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	if out, err := cmd.CombinedOutput(); !strings.Contains(string(out), "not available") {
+		t.Errorf("want unavailable governor error, got err %v, output:\n%s", err, out)
+	}
+	if gov, err := cpupowertest.Governor(root, 0); err != nil || gov != "schedutil" {
+		t.Errorf("after rejected request, governor is %q (err %v), want schedutil", gov, err)
+	}
+}
+
+func TestMaxHold(t *testing.T) {
+	t.Parallel()
+
+	conf := filepath.Join(t.TempDir(), "perflock.conf")
+	if err := os.WriteFile(conf, []byte("max-hold 100ms\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socket := socketName(t)
+	mustStartDaemon(t, socket, "-config="+conf)
+
+	cmd := exec.Command(os.Args[0], "-socket="+socket, daemonUser, "-governor=none", "sleep", "1")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "lock revoked") {
+		t.Errorf("want lock revoked, got:\n%s", out)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	cfg := defaultConfig()
+	const conf = `
+allow-exclusive @perf bob
+allow-tuning uid:1001
+shared-only svc-build
+`
+	if err := cfg.parse("perflock.conf", strings.NewReader(conf)); err != nil {
+		t.Fatal(err)
+	}
+	root := &identity{uid: "0", user: "root"}
+	alice := &identity{uid: "1001", user: "alice", groups: []string{"1001", "alice", "2000", "perf"}}
+	bob := &identity{uid: "1002", user: "bob"}
+	carol := &identity{uid: "1003", user: "carol"}
+	svc := &identity{uid: "1004", user: "svc-build", groups: []string{"2000", "perf"}}
+	for _, test := range []struct {
+		id                *identity
+		exclusive, tuning bool
+	}{
+		{root, true, true},
+		{alice, true, true},
+		{bob, true, false},
+		{carol, false, false},
+		{svc, false, false},
+	} {
+		if got := cfg.mayAcquireExclusive(test.id); got != test.exclusive {
+			t.Errorf("%s: mayAcquireExclusive = %v, want %v", test.id.user, got, test.exclusive)
+		}
+		if got := cfg.mayTune(test.id); got != test.tuning {
+			t.Errorf("%s: mayTune = %v, want %v", test.id.user, got, test.tuning)
+		}
+	}
+
+	// With no policy, everyone may do anything.
+	if cfg := defaultConfig(); !cfg.mayAcquireExclusive(carol) || !cfg.mayTune(carol) {
+		t.Errorf("default policy is restrictive")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.parse("perflock.conf", strings.NewReader("quota-exclusive 1h 24h\nquota-queued 2\n")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	alice := &identity{uid: "1001", user: "alice"}
+
+	// A current hold of 50 minutes is under quota.
+	q := []HoldRecord{{User: "alice", Acquired: now.Add(-50 * time.Minute)}}
+	if _, err := cfg.checkQuota(alice, "", false, q, now); err != nil {
+		t.Errorf("want under quota, got %v", err)
+	}
+	// But 70 minutes is not, unless the request is shared.
+	q[0].Acquired = now.Add(-70 * time.Minute)
+	if _, err := cfg.checkQuota(alice, "", false, q, now); err == nil {
+		t.Errorf("want over exclusive quota")
+	}
+	if _, err := cfg.checkQuota(alice, "", true, q, now); err != nil {
+		t.Errorf("want shared request under quota, got %v", err)
+	}
+	// Too many queued requests.
+	q = append(q, HoldRecord{User: "alice"})
+	if _, err := cfg.checkQuota(alice, "", true, q, now); err == nil {
+		t.Errorf("want over queue quota")
+	}
+	// Root is exempt.
+	if _, err := cfg.checkQuota(&identity{uid: "0", user: "alice"}, "", false, q, now); err != nil {
+		t.Errorf("want root exempt, got %v", err)
+	}
+	// Unless it's someone using sudo, who is charged for their
+	// holds as root.
+	root := &identity{uid: "0", user: "root"}
+	sudo := []HoldRecord{{User: "root", RealUser: "carol", Acquired: now.Add(-70 * time.Minute)}}
+	if _, err := cfg.checkQuota(root, "carol", false, sudo, now); err == nil {
+		t.Errorf("want sudo user over exclusive quota")
+	}
+	if _, err := cfg.checkQuota(root, "", false, sudo, now); err != nil {
+		t.Errorf("want root exempt, got %v", err)
+	}
+	// Demotion instead of rejection.
+	cfg.quotaDemote = true
+	if demote, err := cfg.checkQuota(alice, "", false, q, now); !demote || err != nil {
+		t.Errorf("want demotion, got %v, %v", demote, err)
+	}
+}
+
+func TestDemote(t *testing.T) {
+	var l PerfLock
+	holder := l.Enqueue(HoldRecord{Msg: "holder"}, false)
+	l.Enqueue(HoldRecord{Msg: "demoted", Demoted: true}, false)
+	l.Enqueue(HoldRecord{Msg: "normal"}, false)
+	var got []string
+	for _, h := range l.Queue() {
+		got = append(got, h.Msg)
+	}
+	if want := "holder normal demoted"; strings.Join(got, " ") != want {
+		t.Errorf("got queue %q, want %q", got, want)
+	}
+	l.Dequeue(holder)
+}
+
+// funcname returns the function name of the caller.
+func funcname(skip int) string {
+	var pcs [1]uintptr
+	if runtime.Callers(skip+1, pcs[:]) != 1 {
+		return "UNKNOWN"
+	}
+	fr, _ := runtime.CallersFrames(pcs[:]).Next()
+	return fr.Func.Name()
+}
+
+// daemonUser tells a perflock client to trust the daemons the tests
+// start, which run as the test's user.
+var daemonUser = "-daemon-user=" + strconv.Itoa(os.Getuid())
+
+// socketName returns a unique socket name per test.
+func socketName(t *testing.T) string {
+	if runtime.GOOS == "linux" {
+		// Abstract sockets are automatically cleaned up when the process that
+		// created it (the daemon) exits. Avoids potential complications with the
+		// filesystem (read-only fs, ...) and leftovers from ctrl-c'ing the test
+		// prematurely.
+		return fmt.Sprintf("@perflock.%d.%s", os.Getpid(), funcname(2))
+	} else {
+		return filepath.Join(t.TempDir(), "perflock.socket")
+	}
+}
+
+// mustStartSleeper starts a perflock client running a sleeper.
+func mustStartSleeper(t *testing.T, socket string, argv ...string) *exec.Cmd {
+	t.Helper()
+	cmd, err := startProcess(t, append(argv, "-socket="+socket, daemonUser, os.Args[0]), []string{"GO_TEST_MODE=perflock", "GO_TEST_PROGRAM_MODE=sleeper"})
+	if err != nil {
+		t.Fatalf("could not start sleeper: %v", err)
+	}
+	return cmd
+}
+
+// mustStartDaemon starts a perflock daemon and wait for it to start listening on
+// the socket.
+func mustStartDaemon(t *testing.T, socket string, argv ...string) *exec.Cmd {
+	t.Helper()
+	dir := t.TempDir()
+	argv = append([]string{"-socket=" + socket, "-daemon", "-config=" + filepath.Join(dir, "perflock.conf"), "-history-file=" + filepath.Join(dir, "history"), "-state-file=" + filepath.Join(dir, "state.json")}, argv...)
+	cmd, err := startProcess(t, argv, []string{"GO_TEST_MODE=perflock"})
+	if err != nil {
+		t.Fatalf("could not start daemon: %v", err)
+	}
+	t.Logf("started daemon... waiting for it to become connectable")
+	{
+		ctx := context.Background()
+		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+		if !waitForDaemon(t, ctx, socket) {
+			t.Fatalf("gave up waiting for daemon")
+		}
+		t.Logf("daemon started!")
+	}
+	return cmd
+}
+
+// waitFor polls cond until it returns true or 5 seconds pass, and
+// reports whether cond returned true.
+func waitFor(t *testing.T, cond func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+	return true
+}
+
+// mustRunPerflock runs a perflock client to completion and returns its
+// standard output.
+func mustRunPerflock(t *testing.T, socket string, argv ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-socket=" + socket, daemonUser}, argv...)...)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE=perflock")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("perflock %s failed: %v", strings.Join(argv, " "), err)
+	}
+	return string(out)
 }
 
 func startProcess(t *testing.T, argv []string, env []string) (*exec.Cmd, error) {
@@ -0,0 +1,122 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// identity is the identity of a connected client, as determined from
+// its peer credentials.
+type identity struct {
+	uid  string
+	user string
+	// groups are the names and IDs of the user's groups.
+	groups []string
+}
+
+// lookupIdentity returns the identity of the user with ID uid.
+func lookupIdentity(uid string) *identity {
+	id := &identity{uid: uid, user: "???"}
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return id
+	}
+	id.user = u.Username
+	gids, _ := u.GroupIds()
+	for _, gid := range gids {
+		id.groups = append(id.groups, gid)
+		if g, err := user.LookupGroupId(gid); err == nil {
+			id.groups = append(id.groups, g.Name)
+		}
+	}
+	return id
+}
+
+// lookupUID returns the user ID of name, which may be a user name or a
+// numeric user ID.
+func lookupUID(name string) (string, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return name, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+// isRoot returns whether id is the superuser, which policy never
+// restricts.
+func (id *identity) isRoot() bool {
+	return id.uid == "0"
+}
+
+// accessList is a list of principals. Each principal is one of:
+//
+//	name      the user with this name
+//	uid:N     the user with this user ID
+//	@group    members of this group, by name or ID
+//	*         everyone
+//
+// A nil accessList is unset and, depending on the policy, may mean
+// everyone.
+type accessList []string
+
+// add returns a with principals added. The result is non-nil, even
+// if there are no principals.
+func (a accessList) add(principals []string) accessList {
+	return append(append(accessList{}, a...), principals...)
+}
+
+// match returns whether id matches any principal in a.
+func (a accessList) match(id *identity) bool {
+	for _, p := range a {
+		switch {
+		case p == "*":
+			return true
+		case strings.HasPrefix(p, "uid:"):
+			if p[len("uid:"):] == id.uid {
+				return true
+			}
+		case strings.HasPrefix(p, "@"):
+			for _, g := range id.groups {
+				if p[1:] == g {
+					return true
+				}
+			}
+		default:
+			if p == id.user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayAcquireExclusive returns whether id may acquire the lock in
+// exclusive mode.
+func (cfg *daemonConfig) mayAcquireExclusive(id *identity) bool {
+	if id.isRoot() {
+		return true
+	}
+	if cfg.sharedOnly.match(id) {
+		return false
+	}
+	return cfg.allowExclusive == nil || cfg.allowExclusive.match(id)
+}
+
+// mayTune returns whether id may change CPU settings.
+func (cfg *daemonConfig) mayTune(id *identity) bool {
+	if id.isRoot() {
+		return true
+	}
+	if cfg.sharedOnly.match(id) {
+		return false
+	}
+	return cfg.allowTuning == nil || cfg.allowTuning.match(id)
+}
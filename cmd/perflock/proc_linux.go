@@ -0,0 +1,154 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Linux system call numbers for pidfds. Since these were added after
+// the system call tables were unified, they are the same on all
+// architectures.
+const (
+	sysPidfdSendSignal = 424
+	sysPidfdOpen       = 434
+)
+
+// process is a handle to a client process that can tell whether that
+// process is still running, even if its PID is later reused.
+type process struct {
+	pid int
+
+	// pidfd refers to the process, or is -1 if the kernel does
+	// not support pidfds.
+	pidfd int
+
+	// start is the process's start time, used to detect PID reuse
+	// when there is no pidfd.
+	start string
+}
+
+// openProcess returns a handle to the running process pid.
+func openProcess(pid int) (*process, error) {
+	p := &process{pid: pid, pidfd: -1}
+	if fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0); errno == 0 {
+		p.pidfd = int(fd)
+	}
+	_, start, err := procStat(pid)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	p.start = start
+	return p, nil
+}
+
+// alive returns whether p is still running.
+func (p *process) alive() bool {
+	if p.pidfd >= 0 {
+		_, _, errno := syscall.Syscall6(sysPidfdSendSignal, uintptr(p.pidfd), 0, 0, 0, 0, 0)
+		if errno == syscall.ESRCH {
+			return false
+		}
+	}
+	state, start, err := procStat(p.pid)
+	if err != nil || start != p.start {
+		// The process is gone, possibly replaced by another
+		// with the same PID.
+		return false
+	}
+	// A zombie has exited but not been reaped.
+	return state != "Z"
+}
+
+// close releases the resources held by p. p may be nil.
+func (p *process) close() {
+	if p != nil && p.pidfd >= 0 {
+		syscall.Close(p.pidfd)
+		p.pidfd = -1
+	}
+}
+
+// procStat returns the state and start time of process pid.
+func procStat(pid int) (state, start string, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", "", err
+	}
+	// The command name is parenthesized and may itself contain
+	// spaces and parentheses, so skip to the last ")". The
+	// remaining fields start at field 3 (state), and the start
+	// time is field 22. See proc(5).
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return "", "", fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	f := strings.Fields(string(data[i+1:]))
+	if len(f) < 20 {
+		return "", "", fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return f[0], f[19], nil
+}
+
+// procRealUID returns the ID of the user who originally logged in
+// and started process pid, which is running as user uid, or "" if
+// unknown. This differs from uid if the user switched users with sudo
+// or su.
+func procRealUID(pid int, uid string) string {
+	// The login UID is set by PAM when the user logs in and
+	// survives sudo and su. 4294967295 means it is unset.
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/loginuid", pid)); err == nil {
+		if uid := strings.TrimSpace(string(data)); uid != "" && uid != "4294967295" {
+			return uid
+		}
+	}
+	// Otherwise, sudo records the invoking user in the
+	// environment. Anyone can set this, so only believe it from a
+	// process running as root, as sudo does.
+	if uid != "0" {
+		return ""
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return ""
+	}
+	for _, kv := range bytes.Split(data, []byte{0}) {
+		if uid, ok := bytes.CutPrefix(kv, []byte("SUDO_UID=")); ok {
+			return string(uid)
+		}
+	}
+	return ""
+}
+
+// procCgroup returns the cgroup of process pid, or "" if unknown. On
+// hybrid cgroup v1/v2 systems, this is the unified (v2) cgroup.
+func procCgroup(pid int) string {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	// Each line is hierarchy-ID:controllers:path.
+	var first string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if first == "" {
+			first = parts[2]
+		}
+	}
+	return first
+}
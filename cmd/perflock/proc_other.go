@@ -0,0 +1,42 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// process is a handle to a client process that can tell whether that
+// process is still running. On this platform, it can't detect PID
+// reuse.
+type process struct {
+	pid int
+}
+
+// openProcess returns a handle to the running process pid.
+func openProcess(pid int) (*process, error) {
+	return &process{pid}, nil
+}
+
+// alive returns whether p is still running.
+func (p *process) alive() bool {
+	err := syscall.Kill(p.pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// close releases the resources held by p. p may be nil.
+func (p *process) close() {}
+
+// procRealUID returns the ID of the user who originally logged in
+// and started process pid, which is running as user uid, or "" if
+// unknown.
+func procRealUID(pid int, uid string) string {
+	return ""
+}
+
+// procCgroup returns the cgroup of process pid, or "" if unknown.
+func procCgroup(pid int) string {
+	return ""
+}
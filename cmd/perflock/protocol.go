@@ -4,19 +4,93 @@
 
 package main
 
-import "encoding/gob"
+import (
+	"encoding/gob"
+	"io"
+	"time"
+)
 
 type PerfLockAction struct {
 	Action interface{}
 }
 
-// ActionAcquire acquires the lock. The response is a boolean
-// indicating whether or not the lock was acquired (which may be false
-// for a non-blocking acquire).
+// protocolVersion is the version of the protocol this client speaks.
+// Clients send their version in ActionAcquire, and the daemon replies
+// in the form that version expects, so a new daemon keeps serving old
+// clients:
+//
+//   - Version 0 clients (which predate versioning) expect a bool
+//     reply to ActionAcquire and don't read Notices. The daemon can't
+//     tell them why it refused an acquisition, so it closes the
+//     connection instead.
+//   - Version 1 clients expect an AcquireResponse and read Notices.
+//
+// Daemons that predate versioning reply to any client with a bool,
+// which a newer client reports as an unsupported daemon.
+const protocolVersion = 1
+
+// ActionAcquire acquires the lock. The response is an
+// AcquireResponse, or a bool indicating whether the lock was acquired
+// if Version is 0.
 type ActionAcquire struct {
 	Shared      bool
 	NonBlocking bool
 	Msg         string
+
+	// Version is the client's protocolVersion.
+	Version int
+
+	// Handoff indicates that the client supports being handed off
+	// to a new daemon process (see handoff.go). Such a client
+	// handles Reset responses and, after acquiring an exclusive
+	// lock, always sends ActionSetGovernor before reading only
+	// Notices.
+	Handoff bool
+}
+
+// AcquireResponse is the response to ActionAcquire.
+type AcquireResponse struct {
+	// Acquired indicates whether or not the lock was acquired.
+	// This may be false for a non-blocking acquire, or if the
+	// daemon refused the acquisition, in which case Err explains
+	// why.
+	Acquired bool
+	Err      string
+
+	// Reset indicates that the daemon is handing the connection
+	// to a new daemon process while the client is waiting for the
+	// lock. The client must reply with ActionReset, start new gob
+	// streams, and continue waiting for an AcquireResponse.
+	Reset bool
+
+	// FinalNotice indicates that the daemon supports
+	// ActionRelease.Wait.
+	FinalNotice bool
+}
+
+// Notice is a message the daemon sends to a client that holds the
+// lock, such as to warn that the lock has been released. Once a client
+// has acquired the lock and set the governor, the only messages the
+// daemon sends it are Notices.
+type Notice struct {
+	Msg string
+
+	// Reset indicates that the daemon is handing the connection
+	// to a new daemon process. The client must reply with
+	// ActionReset and start new gob streams.
+	Reset bool
+
+	// Released indicates that the daemon has processed an
+	// ActionRelease with Wait set. It is the last Notice on the
+	// connection.
+	Released bool
+}
+
+// ActionReset acknowledges a Reset from the daemon. It is the last
+// message in the client's gob stream; the client starts a new stream
+// for any further messages, and expects a new stream from the
+// daemon. There is no response.
+type ActionReset struct {
 }
 
 // ActionList returns the list of current and pending lock
@@ -24,16 +98,163 @@ type ActionAcquire struct {
 type ActionList struct {
 }
 
+// ActionEstimateWait returns the estimated time until a new
+// acquisition with the given parameters would acquire the lock, as a
+// time.Duration, or -1 if this is unknown. Estimates are based on the
+// history of previous runs of the same commands.
+type ActionEstimateWait struct {
+	Shared bool
+	Msg    string
+}
+
 // ActionSetGovernor sets the CPU frequency of all CPUs. The caller
-// must hold the lock.
+// must hold the lock. The response is an error string, or "" on
+// success.
 type ActionSetGovernor struct {
 	// Percent indicates the percent to set the CPU governor to
 	// between the lower and highest available frequencies.
 	Percent int
+
+	// Default indicates to use the daemon's configured default
+	// governor setting instead of Percent.
+	Default bool
+
+	// Profile, if non-empty, indicates to apply the daemon's
+	// named tuning profile instead of Percent.
+	Profile string
+
+	// Turbo is "off" to disable turbo boost, "on" to enable it, or
+	// "" for the setting of the profile or the daemon's default,
+	// which is normally to leave it alone.
+	Turbo string
+
+	// CPUGovernor, if non-empty, is the name of the kernel
+	// scaling governor to use, such as "performance". Otherwise,
+	// the daemon uses the profile's or its default setting,
+	// which is normally to leave it alone.
+	CPUGovernor string
+}
+
+// ActionRelease releases the lock after the command run under it
+// has finished. The caller must hold the lock. There is no
+// response.
+type ActionRelease struct {
+	// Exited indicates that the command exited normally with
+	// status ExitStatus. If false, the command failed to start
+	// or was killed by a signal.
+	Exited     bool
+	ExitStatus int
+
+	// Wait asks the daemon to reply with a Notice with Released
+	// set, which reports on the CPU frequency during the run. The
+	// client should only set this if the daemon supports it, as
+	// indicated by AcquireResponse.FinalNotice.
+	Wait bool
+}
+
+// ActionHistory returns the recorded history of completed holds
+// as a []HoldRecord.
+type ActionHistory struct {
+	// User, if non-empty, restricts the results to holds by
+	// this user.
+	User string
+	// Since restricts the results to holds released at or
+	// after this time.
+	Since time.Time
+}
+
+// ActionStatus returns the daemon's status as a StatusResponse.
+type ActionStatus struct {
+}
+
+// StatusResponse is the response to ActionStatus.
+type StatusResponse struct {
+	Version string
+	PID     int
+	// Started is when the daemon started, including any daemons
+	// that handed off to this one.
+	Started time.Time
+	Socket  string
+	// Conns is the number of client connections, not counting
+	// the one requesting the status.
+	Conns int
+	// Draining describes why the daemon is not accepting new
+	// connections, or is "" if it is.
+	Draining string
+
+	// Lock is "free", "shared", or "exclusive".
+	Lock string
+	// Queue is the current and pending lock acquisitions, in the
+	// format of ActionList.
+	Queue []string
+
+	// Driver is the cpufreq driver of the first frequency domain,
+	// and DriverMode is the operation mode of the intel_pstate or
+	// amd-pstate driver, if the host has one.
+	Driver, DriverMode string
+
+	Domains []DomainStatus
+	// Restore lists CPU settings that will be restored when the
+	// connections that changed them release the lock.
+	Restore []RestoreStatus
+
+	// Errors lists problems reading the status.
+	Errors []string
+}
+
+// DomainStatus is the current tuning of one CPU frequency domain.
+type DomainStatus struct {
+	Name string
+	// CPUs lists the online CPUs in the domain.
+	CPUs               []int
+	Min, Max           int
+	AvailMin, AvailMax int
+
+	// ScalingGovernor is the kernel scaling governor the domain
+	// is using.
+	ScalingGovernor string
+	// EPP is the domain's energy performance preference, if it
+	// has one.
+	EPP string
+
+	// Governor and Turbo are the governor and turbo boost
+	// settings applied by the lock holder, if any, and TunedBy is
+	// that holder.
+	Governor, Turbo, TunedBy string
+}
+
+// RestoreStatus is a saved CPU setting waiting to be restored.
+type RestoreStatus struct {
+	Domain   string
+	Min, Max int
+	// Conn is the connection that changed the setting, or 0 if it
+	// was left behind by a previous daemon and could not be
+	// restored.
+	Conn uint64
 }
 
 func init() {
 	gob.Register(ActionAcquire{})
 	gob.Register(ActionList{})
+	gob.Register(ActionEstimateWait{})
 	gob.Register(ActionSetGovernor{})
+	gob.Register(ActionRelease{})
+	gob.Register(ActionHistory{})
+	gob.Register(ActionReset{})
+	gob.Register(ActionStatus{})
+}
+
+// unbufferedReader is an io.ByteReader that reads directly from a
+// connection. gob buffers reads from a reader that is not an
+// io.ByteReader, which could consume the start of the next stream
+// after a Reset. Given an io.ByteReader, it reads exactly one message
+// at a time.
+type unbufferedReader struct {
+	io.Reader
+}
+
+func (r unbufferedReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
 }
@@ -0,0 +1,112 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// exclusiveQuota limits the total time a user may hold the lock in
+// exclusive mode over a rolling window.
+type exclusiveQuota struct {
+	limit, window time.Duration
+}
+
+// checkQuota checks whether a new request by id would exceed its
+// quotas, given the current lock queue q. If the request is within
+// quota, it returns false, nil. If the request is over quota, it
+// returns true, nil if the request should be demoted to low priority,
+// or an error if the request should be rejected.
+//
+// Quotas are charged to realUser if it is set, such as the user who
+// ran sudo. Otherwise they are charged to id, and never apply to
+// root.
+func (cfg *daemonConfig) checkQuota(id *identity, realUser string, shared bool, q []HoldRecord, now time.Time) (demote bool, err error) {
+	user := realUser
+	if user == "" {
+		if id.isRoot() {
+			return false, nil
+		}
+		user = id.user
+	}
+	err = cfg.overQuota(user, shared, q, now)
+	if err == nil {
+		return false, nil
+	}
+	if cfg.quotaDemote {
+		return true, nil
+	}
+	return false, err
+}
+
+// overQuota returns an error describing the first quota that a new
+// request by user would exceed, or nil.
+func (cfg *daemonConfig) overQuota(user string, shared bool, q []HoldRecord, now time.Time) error {
+	if cfg.quotaQueued > 0 {
+		n := 0
+		for _, h := range q {
+			if h.QuotaUser() == user {
+				n++
+			}
+		}
+		if n >= cfg.quotaQueued {
+			return fmt.Errorf("user %s already has %d requests queued (quota %d)", user, n, cfg.quotaQueued)
+		}
+	}
+
+	if shared || len(cfg.quotaExclusive) == 0 {
+		return nil
+	}
+	hist := theHistory.ExclusiveHolds(user, now.Add(-cfg.quotaWindow()))
+	// Include current holds.
+	for _, h := range q {
+		if h.QuotaUser() == user && !h.Acquired.IsZero() {
+			h.Released = now
+			hist = append(hist, h)
+		}
+	}
+	for _, quota := range cfg.quotaExclusive {
+		used := exclusiveTime(hist, now.Add(-quota.window), now)
+		if used >= quota.limit {
+			return fmt.Errorf("user %s has held the lock exclusively for %s in the last %s (quota %s)", user, used.Round(time.Second), quota.window, quota.limit)
+		}
+	}
+	return nil
+}
+
+// quotaWindow returns the longest exclusive quota window, which is
+// how much history quotas need.
+func (cfg *daemonConfig) quotaWindow() time.Duration {
+	var window time.Duration
+	for _, quota := range cfg.quotaExclusive {
+		if quota.window > window {
+			window = quota.window
+		}
+	}
+	return window
+}
+
+// exclusiveTime returns the total time that holds in hist held the
+// lock exclusively between start and end.
+func exclusiveTime(hist []HoldRecord, start, end time.Time) time.Duration {
+	var total time.Duration
+	for _, h := range hist {
+		if h.Shared {
+			continue
+		}
+		from, to := h.Acquired, h.Released
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			total += to.Sub(from)
+		}
+	}
+	return total
+}
@@ -0,0 +1,128 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long the daemon waits for connections to
+// shut down cleanly before exiting anyway.
+const shutdownTimeout = 30 * time.Second
+
+// servers tracks the daemon's connected clients so they can be shut
+// down cleanly.
+var servers struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	m        map[*Server]bool
+	stopping bool
+
+	// perUser counts connections by user ID. See addConn.
+	perUser map[string]int
+
+	// handoff is closed to ask all servers to prepare to hand off
+	// their connections to a new daemon. See handoff.go.
+	handoff chan struct{}
+}
+
+// startServer starts s serving its connection. It returns false if
+// the daemon is shutting down.
+func startServer(s *Server) bool {
+	servers.Lock()
+	defer servers.Unlock()
+	if servers.stopping {
+		return false
+	}
+	if servers.m == nil {
+		servers.m = make(map[*Server]bool)
+	}
+	servers.m[s] = true
+	servers.wg.Add(1)
+
+	go func() {
+		defer servers.wg.Done()
+		defer s.c.Close()
+		defer close(s.done)
+		s.Serve()
+
+		servers.Lock()
+		delete(servers.m, s)
+		servers.Unlock()
+	}()
+	return true
+}
+
+// handoffRequested returns a channel that is closed when the daemon
+// starts handing off connections to a new daemon.
+func handoffRequested() <-chan struct{} {
+	servers.Lock()
+	defer servers.Unlock()
+	if servers.handoff == nil {
+		servers.handoff = make(chan struct{})
+	}
+	return servers.handoff
+}
+
+// shuttingDown returns whether the daemon is shutting down.
+func shuttingDown() bool {
+	servers.Lock()
+	defer servers.Unlock()
+	return servers.stopping
+}
+
+// handleSignals shuts down the daemon when it receives SIGTERM or
+// SIGINT, calls reload when it receives SIGHUP, and calls upgrade
+// when it receives SIGUSR2.
+func handleSignals(l net.Listener, reload, upgrade func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP, syscall.SIGUSR2)
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			reload()
+			continue
+		case syscall.SIGUSR2:
+			upgrade()
+			continue
+		}
+		slog.Info("shutting down", "event", "shutdown", "signal", sig.String())
+		shutdown(l)
+		os.Exit(0)
+	}
+}
+
+// shutdown stops accepting new connections, tells all clients the
+// daemon is going away, and waits for them to release their locks
+// and restore any CPU settings.
+func shutdown(l net.Listener) {
+	sdNotify("STOPPING=1")
+
+	servers.Lock()
+	servers.stopping = true
+	for s := range servers.m {
+		s.stopServing()
+	}
+	servers.Unlock()
+	l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		servers.wg.Wait()
+		pendingHooks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		slog.Warn("timed out waiting for connections to shut down", "event", "shutdown")
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aclements/perflock/internal/cpupower"
+)
+
+// StateFile records the original CPU settings that connections have
+// changed, so they can be restored if the daemon crashes before it
+// restores them itself.
+//
+// A nil *StateFile records nothing.
+type StateFile struct {
+	path string
+
+	mu    sync.Mutex
+	state savedState
+}
+
+// savedState is the on-disk format of a StateFile.
+type savedState struct {
+	// Saved lists the settings saved by each connection, in the
+	// order they were saved. If several connections changed the
+	// same settings, the first entry has the true original values.
+	Saved []savedTuning
+}
+
+// savedTuning is the original CPU settings saved by one connection.
+type savedTuning struct {
+	Conn   uint64
+	Ranges []savedRange
+	Turbo  []savedTurbo `json:",omitempty"`
+	// PerfPct is the global performance limits of the P-state
+	// driver, if it has them.
+	PerfPct *savedPerfPct `json:",omitempty"`
+}
+
+type savedRange struct {
+	// Domain is the sysfs path of the frequency domain.
+	Domain   string
+	Min, Max int
+
+	// Governor is the scaling governor, if known, and Speed is
+	// the userspace governor's frequency if Governor is
+	// "userspace".
+	Governor string `json:",omitempty"`
+	Speed    int    `json:",omitempty"`
+
+	// EPP is the energy performance preference, if the domain has
+	// one.
+	EPP string `json:",omitempty"`
+}
+
+// settings returns the settings r records for domain d.
+func (r savedRange) settings(d *cpupower.Domain) *governorSettings {
+	return &governorSettings{d, r.Min, r.Max, r.Governor, r.Speed, r.EPP}
+}
+
+type savedTurbo struct {
+	// Path is the sysfs path of the turbo boost control.
+	Path    string
+	Enabled bool
+}
+
+type savedPerfPct struct {
+	// Path is the sysfs directory of the P-state driver.
+	Path     string
+	Min, Max int
+	// Status is the driver's operation mode, if known.
+	Status string `json:",omitempty"`
+}
+
+// settings returns the settings p records, or nil if p is nil.
+func (p *savedPerfPct) settings() *pstateSettings {
+	if p == nil {
+		return nil
+	}
+	return &pstateSettings{cpupower.NewPState(p.Path), p.Min, p.Max, p.Status}
+}
+
+var theState *StateFile
+
+// OpenStateFile returns the StateFile at path. If path records
+// settings left behind by a previous daemon, it first restores those
+// settings. If that fails, it logs the failure and keeps the settings
+// in the state file. If path can't be parsed, it logs the failure,
+// renames it to path.corrupt, and starts with no saved settings.
+func OpenStateFile(path string) (*StateFile, error) {
+	sf := &StateFile{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sf, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var old savedState
+	if err := json.Unmarshal(data, &old); err != nil {
+		// Don't let a damaged file keep the daemon from
+		// starting, but keep it around for inspection.
+		slog.Error("reading state file; CPU settings left behind by a previous daemon will not be restored", "event", "restore", "path", path, "err", err)
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			return nil, err
+		}
+		return sf, nil
+	}
+	if len(old.Saved) == 0 {
+		return sf, nil
+	}
+	slog.Info("restoring CPU settings left behind by previous daemon", "event", "restore", "path", path)
+	if err := old.restore(); err != nil {
+		// Keep the old settings around so we try again
+		// next time. Connection IDs start at 1, so these
+		// won't be cleared by a new connection.
+		slog.Error("restoring CPU settings", "event", "restore", "path", path, "err", err)
+		for _, t := range old.Saved {
+			t.Conn = 0
+			sf.state.Saved = append(sf.state.Saved, t)
+		}
+	}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if err := sf.write(); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// restore restores all of the settings in st.
+func (st *savedState) restore() error {
+	byPath, err := domainsByPath()
+	if err != nil {
+		return err
+	}
+
+	// Restore in reverse order so the oldest (original) settings
+	// win. Try to restore everything, even if something fails.
+	// Restore turbo boost first, since disabling it may have
+	// limited the frequency ranges.
+	for i := len(st.Saved) - 1; i >= 0; i-- {
+		for _, t := range st.Saved[i].Turbo {
+			if err1 := cpupower.NewTurbo(t.Path).SetEnabled(t.Enabled); err1 != nil && err == nil {
+				err = err1
+			}
+		}
+		if p := st.Saved[i].PerfPct.settings(); p != nil {
+			if err1 := p.restore(); err1 != nil && err == nil {
+				err = err1
+			}
+		}
+		for _, r := range st.Saved[i].Ranges {
+			d := byPath[r.Domain]
+			if d == nil {
+				if err == nil {
+					err = fmt.Errorf("unknown frequency domain %s", r.Domain)
+				}
+				continue
+			}
+			if err1 := r.settings(d).restore(); err1 != nil && err == nil {
+				err = err1
+			}
+		}
+	}
+	return err
+}
+
+// domainsByPath returns the CPU frequency domains, indexed by their
+// sysfs paths. Domains are also indexed by the cpufreq directories of
+// their CPUs, which older daemons recorded instead.
+func domainsByPath() (map[string]*cpupower.Domain, error) {
+	domains, err := cpupower.Domains()
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*cpupower.Domain)
+	for _, d := range domains {
+		for _, cpu := range d.CPUs() {
+			byPath[filepath.Join(cpupower.SysfsRoot, "devices/system/cpu", fmt.Sprintf("cpu%d", cpu), "cpufreq")] = d
+		}
+	}
+	for _, d := range domains {
+		byPath[d.Path()] = d
+	}
+	return byPath, nil
+}
+
+// ResumeStateFile returns a StateFile at path that records saved,
+// the settings saved by another daemon that handed off its
+// connections. Unlike OpenStateFile, it does not restore anything.
+func ResumeStateFile(path string, saved []savedTuning) (*StateFile, error) {
+	sf := &StateFile{path: path, state: savedState{Saved: saved}}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if err := sf.write(); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// Saved returns the settings currently recorded in sf.
+func (sf *StateFile) Saved() []savedTuning {
+	if sf == nil {
+		return nil
+	}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return append([]savedTuning(nil), sf.state.Saved...)
+}
+
+// Save records the original settings gs, ts, and ps of connection
+// conn. ps may be nil. This must be called before changing the
+// settings.
+func (sf *StateFile) Save(conn uint64, gs []*governorSettings, ts []*turboSettings, ps *pstateSettings) error {
+	if sf == nil {
+		return nil
+	}
+	t := savedTuning{Conn: conn}
+	for _, g := range gs {
+		t.Ranges = append(t.Ranges, g.saved())
+	}
+	for _, ts := range ts {
+		t.Turbo = append(t.Turbo, savedTurbo{ts.turbo.Path(), ts.enabled})
+	}
+	t.PerfPct = ps.saved()
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.state.Saved = append(sf.state.Saved, t)
+	return sf.write()
+}
+
+// Clear forgets the settings saved by connection conn, once it has
+// restored them.
+func (sf *StateFile) Clear(conn uint64) error {
+	if sf == nil {
+		return nil
+	}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	saved := sf.state.Saved[:0]
+	for _, t := range sf.state.Saved {
+		if t.Conn != conn {
+			saved = append(saved, t)
+		}
+	}
+	sf.state.Saved = saved
+	return sf.write()
+}
+
+// write atomically replaces the state file with sf.state. If there
+// is nothing to restore, it removes the state file.
+func (sf *StateFile) write() error {
+	if len(sf.state.Saved) == 0 {
+		err := os.Remove(sf.path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(&sf.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sf.path), 0755); err != nil {
+		return err
+	}
+	tmp := sf.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, sf.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/aclements/perflock/internal/cpupower"
+)
+
+// Exit statuses of perflock -status.
+const (
+	statusFree      = 0
+	statusShared    = 3
+	statusExclusive = 4
+)
+
+var (
+	// daemonStarted is when the daemon started serving. A daemon
+	// that takes over from another keeps the original time.
+	daemonStarted = time.Now()
+
+	// daemonSocket is the address of the daemon's listening
+	// socket.
+	daemonSocket string
+)
+
+// version returns the version of the perflock binary, from its build
+// information.
+func version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := bi.Main.Version
+	if v != "" && v != "(devel)" {
+		// Module versions, including pseudo-versions, already
+		// identify the revision.
+		return v
+	}
+	var rev string
+	var dirty bool
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if rev == "" {
+		return "(devel)"
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if dirty {
+		rev += "+dirty"
+	}
+	return rev
+}
+
+// status returns the daemon's status, as requested by s.
+func (s *Server) status() StatusResponse {
+	now := time.Now()
+	st := StatusResponse{
+		Version: version(),
+		PID:     os.Getpid(),
+		Started: daemonStarted,
+		Socket:  daemonSocket,
+		Lock:    "free",
+	}
+
+	servers.Lock()
+	st.Conns = len(servers.m)
+	if servers.m[s] {
+		st.Conns--
+	}
+	if servers.stopping {
+		st.Draining = "shutting down"
+	}
+	servers.Unlock()
+	select {
+	case <-handoffRequested():
+		st.Draining = "handing off to new daemon"
+	default:
+	}
+
+	q := theLock.Queue()
+	st.Queue = formatQueue(q, now)
+	var tuner *HoldRecord
+	for i, h := range q {
+		if h.Acquired.IsZero() {
+			continue
+		}
+		if h.Shared {
+			st.Lock = "shared"
+		} else {
+			st.Lock = "exclusive"
+		}
+		if h.Governor != "" || h.Turbo != "" || h.CPUGovernor != "" {
+			tuner = &q[i]
+		}
+	}
+
+	domains, err := cpupower.Domains()
+	if err != nil {
+		st.Errors = append(st.Errors, "reading CPU frequency domains: "+err.Error())
+	}
+	if len(domains) > 0 {
+		st.Driver, _ = domains[0].Driver()
+	}
+	if p, err := cpupower.FindPState(); err != nil {
+		st.Errors = append(st.Errors, "reading P-state driver: "+err.Error())
+	} else if p != nil {
+		st.DriverMode, _ = p.Status()
+	}
+	names := make(map[string]string)
+	for _, d := range domains {
+		names[d.Path()] = d.Name()
+		min, max, err := d.CurrentRange()
+		if err != nil {
+			st.Errors = append(st.Errors, "reading CPU frequency: "+err.Error())
+			continue
+		}
+		ds := DomainStatus{Name: d.Name(), CPUs: d.CPUs(), Min: min, Max: max}
+		ds.ScalingGovernor, _ = d.Governor()
+		ds.EPP, _ = d.EPP()
+		ds.AvailMin, ds.AvailMax, _ = d.AvailableRange()
+		if tuner != nil {
+			ds.Governor, ds.Turbo, ds.TunedBy = tuner.Governor, tuner.Turbo, tuner.Who()
+		}
+		st.Domains = append(st.Domains, ds)
+	}
+
+	for _, t := range theState.Saved() {
+		for _, r := range t.Ranges {
+			name := names[r.Domain]
+			if name == "" {
+				name = r.Domain
+			}
+			st.Restore = append(st.Restore, RestoreStatus{name, r.Min, r.Max, t.Conn})
+		}
+	}
+	return st
+}
+
+// printStatus prints st to w and returns the exit status of
+// perflock -status.
+func printStatus(w io.Writer, st StatusResponse, now time.Time) int {
+	fmt.Fprintf(w, "perflock daemon %s, pid %d, up %s\n", st.Version, st.PID, formatEstimate(now.Sub(st.Started)))
+	fmt.Fprintf(w, "socket: %s\n", st.Socket)
+	fmt.Fprintf(w, "connections: %d\n", st.Conns)
+	if st.Draining != "" {
+		fmt.Fprintf(w, "draining: %s\n", st.Draining)
+	}
+	fmt.Fprintf(w, "lock: %s\n", st.Lock)
+	for _, l := range st.Queue {
+		fmt.Fprintf(w, "\t%s\n", l)
+	}
+	if st.Driver != "" {
+		fmt.Fprintf(w, "cpufreq driver: %s", st.Driver)
+		if st.DriverMode != "" {
+			fmt.Fprintf(w, " (%s mode)", st.DriverMode)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, d := range st.Domains {
+		fmt.Fprintf(w, "%s (CPUs %s): %d-%d MHz (available %d-%d MHz)", d.Name, formatCPUs(d.CPUs), d.Min/1000, d.Max/1000, d.AvailMin/1000, d.AvailMax/1000)
+		if d.ScalingGovernor != "" {
+			fmt.Fprintf(w, ", scaling governor %s", d.ScalingGovernor)
+		}
+		if d.EPP != "" {
+			fmt.Fprintf(w, ", EPP %s", d.EPP)
+		}
+		switch {
+		case d.Governor != "" && d.Turbo != "":
+			fmt.Fprintf(w, ", governor %s and turbo %s set by %s", d.Governor, d.Turbo, d.TunedBy)
+		case d.Governor != "":
+			fmt.Fprintf(w, ", governor %s set by %s", d.Governor, d.TunedBy)
+		case d.Turbo != "":
+			fmt.Fprintf(w, ", turbo %s set by %s", d.Turbo, d.TunedBy)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, r := range st.Restore {
+		fmt.Fprintf(w, "pending restore: %s to %d-%d MHz", r.Domain, r.Min/1000, r.Max/1000)
+		if r.Conn == 0 {
+			fmt.Fprintf(w, " (left by previous daemon)\n")
+		} else {
+			fmt.Fprintf(w, " when connection %d releases\n", r.Conn)
+		}
+	}
+	for _, e := range st.Errors {
+		fmt.Fprintf(w, "error: %s\n", e)
+	}
+
+	switch st.Lock {
+	case "shared":
+		return statusShared
+	case "exclusive":
+		return statusExclusive
+	}
+	return statusFree
+}
+
+// formatCPUs formats a sorted list of CPUs in the kernel's list
+// format, such as "0-3,8".
+func formatCPUs(cpus []int) string {
+	var b strings.Builder
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		if i == j {
+			fmt.Fprintf(&b, "%d", cpus[i])
+		} else {
+			fmt.Fprintf(&b, "%d-%d", cpus[i], cpus[j])
+		}
+		i = j + 1
+	}
+	return b.String()
+}
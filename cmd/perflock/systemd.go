@@ -0,0 +1,120 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd
+// socket activation. See sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+// systemdListener returns the listening socket passed to this
+// process by systemd socket activation, or nil if there is none.
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || n == 0 {
+		return nil, nil
+	}
+	// Don't pass these on to hooks.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n != 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets; want 1", n)
+	}
+
+	syscall.CloseOnExec(sdListenFDsStart)
+	f := os.NewFile(sdListenFDsStart, "systemd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends state to the systemd service manager, if this
+// process was started by systemd with a notification socket. See
+// sd_notify(3).
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// withoutNotify returns env without the variables that let a process
+// notify systemd. The service accepts notifications from any of its
+// processes, so the daemon must not pass these on to hooks.
+func withoutNotify(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "NOTIFY_SOCKET=") || strings.HasPrefix(kv, "WATCHDOG_") {
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// acceptBusy is when the accept loop started setting up its current
+// connection, in Unix nanoseconds, or 0 if it is waiting in Accept.
+var acceptBusy atomic.Int64
+
+// healthCheck returns an error if the accept loop has been setting up
+// a connection for longer than limit. It blocks if the lock queue or
+// the server table is deadlocked.
+func healthCheck(limit time.Duration) error {
+	if since := acceptBusy.Load(); since != 0 {
+		if d := time.Since(time.Unix(0, since)); d > limit {
+			return fmt.Errorf("accept loop stuck for %s", d.Round(time.Millisecond))
+		}
+	}
+	theLock.Queue()
+	servers.Lock()
+	servers.Unlock()
+	return nil
+}
+
+// sdWatchdog sends keep-alive pings to the systemd service manager
+// if the service has a watchdog enabled. It does not return.
+//
+// It only pings while healthCheck passes, so systemd restarts a
+// daemon that has stopped serving, not just one that has exited.
+func sdWatchdog() {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	// Ping at twice the required rate, as recommended by
+	// sd_watchdog_enabled(3).
+	interval := time.Duration(usec) * time.Microsecond / 2
+	for range time.Tick(interval) {
+		if err := healthCheck(interval); err != nil {
+			slog.Error("not sending watchdog ping", "err", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Warn("sending watchdog ping", "err", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aclements/perflock/internal/cpupower"
+)
+
+// thermalSnapshot is the thermal state of the host at the start of a
+// hold, to compare against at the end.
+type thermalSnapshot struct {
+	Throttles []cpupower.ThrottleCount
+	Zones     []cpupower.ThermalZone
+}
+
+func takeThermalSnapshot() (*thermalSnapshot, error) {
+	throttles, err := cpupower.ThrottleCounts()
+	if err != nil {
+		return nil, err
+	}
+	zones, err := cpupower.ThermalZones()
+	if err != nil {
+		return nil, err
+	}
+	return &thermalSnapshot{throttles, zones}, nil
+}
+
+// throttlesSince returns the number of thermal throttling events
+// between before and t, and if there were any, a warning describing
+// them and the change in temperatures.
+func (t *thermalSnapshot) throttlesSince(before *thermalSnapshot) (int, string) {
+	old := make(map[int]cpupower.ThrottleCount)
+	for _, c := range before.Throttles {
+		old[c.CPU] = c
+	}
+	var coreCPUs []int
+	var core uint64
+	pkgs := make(map[int]uint64)
+	for _, c := range t.Throttles {
+		o, ok := old[c.CPU]
+		if !ok {
+			continue
+		}
+		if c.CoreThrottles > o.CoreThrottles {
+			core += c.CoreThrottles - o.CoreThrottles
+			coreCPUs = append(coreCPUs, c.CPU)
+		}
+		// Every CPU in a package reports the package's count.
+		if c.PackageThrottles > o.PackageThrottles {
+			pkgs[c.Package] = max(pkgs[c.Package], c.PackageThrottles-o.PackageThrottles)
+		}
+	}
+	var pkg uint64
+	for _, n := range pkgs {
+		pkg += n
+	}
+	if core+pkg == 0 {
+		return 0, ""
+	}
+
+	var what []string
+	if core > 0 {
+		what = append(what, fmt.Sprintf("%d core throttling events on CPUs %s", core, formatCPUs(coreCPUs)))
+	}
+	if pkg > 0 {
+		what = append(what, fmt.Sprintf("%d package throttling events", pkg))
+	}
+	msg := fmt.Sprintf("WARNING: CPUs were thermally throttled during this run (%s); results may be unreliable", strings.Join(what, ", "))
+
+	oldTemps := make(map[string]int)
+	for _, z := range before.Zones {
+		oldTemps[z.Name] = z.Temp
+	}
+	var temps []string
+	for _, z := range t.Zones {
+		if o, ok := oldTemps[z.Name]; ok {
+			name := z.Type
+			if name == "" {
+				name = z.Name
+			}
+			temps = append(temps, fmt.Sprintf("%s %d°C -> %d°C", name, o/1000, z.Temp/1000))
+		}
+	}
+	if len(temps) > 0 {
+		msg += "\ntemperatures: " + strings.Join(temps, ", ")
+	}
+	return int(core + pkg), msg
+}
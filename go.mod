@@ -1,6 +1,6 @@
 module github.com/aclements/perflock
 
-go 1.20
+go 1.21
 
 require inet.af/peercred v0.0.0-20210906144145-0893ea02156a
 
@@ -22,9 +22,9 @@ if [[ -d /etc/init ]]; then
 fi
 if [[ -d /etc/systemd ]]; then
     echo "Installing service for systemd" 1>&2
-    install -m 0644 init/systemd/perflock.service /etc/systemd/system
-    systemctl enable --quiet perflock.service
-    start="systemctl start perflock.service"
+    install -m 0644 init/systemd/perflock.service init/systemd/perflock.socket /etc/systemd/system
+    systemctl enable --quiet perflock.socket perflock.service
+    start="systemctl start perflock.socket perflock.service"
     starttype=" (using systemd)"
 fi
 
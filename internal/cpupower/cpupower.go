@@ -11,21 +11,71 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 )
 
 // Domain is a frequency scaling domain. This may include more than
 // one CPU.
 type Domain struct {
 	path      string
+	cpus      []int
 	min, max  int
 	available []int
 }
 
-var cpuRe = regexp.MustCompile(`cpu\d+$`)
+// SysfsRoot is the directory sysfs is mounted on. Tests can point
+// this at a simulated sysfs tree, such as one built by package
+// cpupowertest.
+var SysfsRoot = "/sys"
 
-// Domains returns the frequency scaling domains of this host.
+var (
+	cpuRe    = regexp.MustCompile(`^cpu(\d+)$`)
+	policyRe = regexp.MustCompile(`^policy\d+$`)
+)
+
+// Domains returns the frequency scaling domains of this host. These
+// are the kernel's cpufreq policies, each of which controls one or
+// more CPUs. Policies whose CPUs are all offline are omitted, since
+// the kernel rejects changes to them.
 func Domains() ([]*Domain, error) {
-	dir := "/sys/devices/system/cpu"
+	dir := filepath.Join(SysfsRoot, "devices/system/cpu/cpufreq")
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var domains []*Domain
+	for _, f := range fs {
+		if !f.IsDir() || !policyRe.MatchString(f.Name()) {
+			continue
+		}
+		pdir := filepath.Join(dir, f.Name())
+		cpus, err := readInts(filepath.Join(pdir, "affected_cpus"))
+		if err != nil {
+			return nil, err
+		}
+		if len(cpus) == 0 {
+			continue
+		}
+		d, err := newDomain(pdir, cpus)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, d)
+	}
+	if len(domains) > 0 {
+		sortDomains(domains)
+		return domains, nil
+	}
+	return legacyDomains()
+}
+
+// legacyDomains returns the frequency scaling domains of a host whose
+// kernel predates cpufreq policy directories. It finds them through
+// each CPU's cpufreq directory, deduplicating by freqdomain_cpus if
+// the driver provides it.
+func legacyDomains() ([]*Domain, error) {
+	dir := filepath.Join(SysfsRoot, "devices/system/cpu")
 	fs, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
@@ -34,41 +84,91 @@ func Domains() ([]*Domain, error) {
 	var domains []*Domain
 	haveDomains := make(map[string]bool)
 	for _, f := range fs {
-		if !f.IsDir() || !cpuRe.MatchString(f.Name()) {
+		m := cpuRe.FindStringSubmatch(f.Name())
+		if !f.IsDir() || m == nil {
 			continue
 		}
 		pdir := filepath.Join(dir, f.Name(), "cpufreq")
+		if _, err := os.Stat(pdir); os.IsNotExist(err) {
+			// This CPU is offline or has no cpufreq driver.
+			continue
+		}
 
 		// Get the frequency domain, if any.
-		cpus, err := ioutil.ReadFile(filepath.Join(pdir, "freqdomain_cpus"))
+		cpu, _ := strconv.Atoi(m[1])
+		cpus := []int{cpu}
+		data, err := ioutil.ReadFile(filepath.Join(pdir, "freqdomain_cpus"))
 		if err == nil {
-			if haveDomains[string(cpus)] {
+			if haveDomains[string(data)] {
 				// We already have a CPU in this domain.
 				continue
 			}
-			haveDomains[string(cpus)] = true
+			haveDomains[string(data)] = true
+			if cpus, err = readInts(filepath.Join(pdir, "freqdomain_cpus")); err != nil {
+				return nil, err
+			}
 		} else if !os.IsNotExist(err) {
 			return nil, err
 		}
 
-		min, err := readInt(filepath.Join(pdir, "cpuinfo_min_freq"))
+		d, err := newDomain(pdir, cpus)
 		if err != nil {
 			return nil, err
 		}
-		max, err := readInt(filepath.Join(pdir, "cpuinfo_max_freq"))
-		if err != nil {
-			return nil, err
-		}
-		avail, err := readInts(filepath.Join(pdir, "scaling_available_frequencies"))
-		if err != nil && !os.IsNotExist(err) {
-			return nil, err
-		}
-		sort.Ints(avail)
-		domains = append(domains, &Domain{pdir, min, max, avail})
+		domains = append(domains, d)
 	}
+	sortDomains(domains)
 	return domains, nil
 }
 
+// newDomain returns the domain of cpus whose settings are in pdir.
+func newDomain(pdir string, cpus []int) (*Domain, error) {
+	min, err := readInt(filepath.Join(pdir, "cpuinfo_min_freq"))
+	if err != nil {
+		return nil, err
+	}
+	max, err := readInt(filepath.Join(pdir, "cpuinfo_max_freq"))
+	if err != nil {
+		return nil, err
+	}
+	avail, err := readInts(filepath.Join(pdir, "scaling_available_frequencies"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Ints(avail)
+	sort.Ints(cpus)
+	return &Domain{pdir, cpus, min, max, avail}, nil
+}
+
+// sortDomains sorts domains by their first CPU, rather than by the
+// names of their directories, which sort cpu10 before cpu2.
+func sortDomains(domains []*Domain) {
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].cpus[0] < domains[j].cpus[0]
+	})
+}
+
+// Path returns the sysfs directory of this domain's settings.
+func (d *Domain) Path() string {
+	return d.path
+}
+
+// Name returns the name of this domain's cpufreq policy, such as
+// "policy0", or on older kernels the name of the CPU this domain was
+// found at, such as "cpu0".
+func (d *Domain) Name() string {
+	if name := filepath.Base(d.path); policyRe.MatchString(name) {
+		return name
+	}
+	return filepath.Base(filepath.Dir(d.path))
+}
+
+// CPUs returns the online CPUs this domain controls, in ascending
+// order.
+func (d *Domain) CPUs() []int {
+	return d.cpus
+}
+
 // AvailableRange returns the available frequency range this CPU is
 // capable of and the set of available frequencies in ascending order
 // or nil if any frequency can be set.
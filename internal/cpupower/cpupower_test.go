@@ -0,0 +1,332 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpupower_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aclements/perflock/internal/cpupower"
+	"github.com/aclements/perflock/internal/cpupower/cpupowertest"
+)
+
+// useSysfs points cpupower at a simulated sysfs tree with layout l
+// for the duration of the test and returns its root.
+func useSysfs(t *testing.T, l cpupowertest.Layout) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := cpupowertest.Build(root, l); err != nil {
+		t.Fatal(err)
+	}
+	old := cpupower.SysfsRoot
+	cpupower.SysfsRoot = root
+	t.Cleanup(func() { cpupower.SysfsRoot = old })
+	return root
+}
+
+func TestDomains(t *testing.T) {
+	legacy, legacyACPI := cpupowertest.PState, cpupowertest.ACPI
+	legacy.Legacy, legacyACPI.Legacy = true, true
+	for _, test := range []struct {
+		name   string
+		layout cpupowertest.Layout
+		want   []string
+		cpus   [][]int
+		avail  []int
+	}{
+		{"pstate", cpupowertest.PState, []string{"policy0", "policy1", "policy2", "policy3"}, [][]int{{0}, {1}, {2}, {3}}, nil},
+		{"acpi", cpupowertest.ACPI, []string{"policy0", "policy2"}, [][]int{{0, 1}, {2, 3}}, []int{1200000, 1600000, 2000000, 2400000}},
+		{"single", cpupowertest.Single, []string{"policy0"}, [][]int{{0}}, nil},
+		{"legacy", legacy, []string{"cpu0", "cpu1", "cpu2", "cpu3"}, [][]int{{0}, {1}, {2}, {3}}, nil},
+		{"legacy-acpi", legacyACPI, []string{"cpu0", "cpu2"}, [][]int{{0, 1}, {2, 3}}, []int{1200000, 1600000, 2000000, 2400000}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useSysfs(t, test.layout)
+			domains, err := cpupower.Domains()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			var cpus [][]int
+			for _, d := range domains {
+				names = append(names, d.Name())
+				cpus = append(cpus, d.CPUs())
+				min, max, avail := d.AvailableRange()
+				if min != test.layout.Min || max != test.layout.Max || !reflect.DeepEqual(avail, test.avail) {
+					t.Errorf("%s: AvailableRange() = %d, %d, %v; want %d, %d, %v", d.Name(), min, max, avail, test.layout.Min, test.layout.Max, test.avail)
+				}
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("got domains %v, want %v", names, test.want)
+			}
+			if !reflect.DeepEqual(cpus, test.cpus) {
+				t.Errorf("got CPUs %v, want %v", cpus, test.cpus)
+			}
+		})
+	}
+}
+
+func TestDomainsOffline(t *testing.T) {
+	root := useSysfs(t, cpupowertest.ACPI)
+	// Take CPUs 2 and 3 offline. The kernel keeps their policy
+	// but rejects changes to it.
+	policy := filepath.Join(root, "devices/system/cpu/cpufreq/policy2")
+	if err := os.WriteFile(filepath.Join(policy, "affected_cpus"), []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	domains, err := cpupower.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Name() != "policy0" {
+		t.Errorf("got %d domains, want only policy0", len(domains))
+	}
+}
+
+func TestSetRange(t *testing.T) {
+	root := useSysfs(t, cpupowertest.PState)
+	domains, err := cpupower.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := domains[1]
+	if err := d.SetRange(1000000, 2000000); err != nil {
+		t.Fatal(err)
+	}
+	if min, max, err := d.CurrentRange(); err != nil || min != 1000000 || max != 2000000 {
+		t.Errorf("CurrentRange() = %d, %d, %v; want 1000000, 2000000, nil", min, max, err)
+	}
+	if min, max, err := cpupowertest.ReadRange(root, 0); err != nil || min != cpupowertest.PState.Min || max != cpupowertest.PState.Max {
+		t.Errorf("cpu0 range = %d, %d, %v; want unchanged", min, max, err)
+	}
+}
+
+func TestTurbo(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		layout   cpupowertest.Layout
+		controls int
+	}{
+		{"pstate", cpupowertest.PState, 1},
+		{"acpi", cpupowertest.ACPI, 1},
+		{"amd", cpupowertest.AMD, 4},
+		{"single", cpupowertest.Single, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root := useSysfs(t, test.layout)
+			turbos, err := cpupower.TurboControls()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(turbos) != test.controls {
+				t.Fatalf("got %d turbo controls, want %d", len(turbos), test.controls)
+			}
+			for _, enabled := range []bool{false, true} {
+				for _, turbo := range turbos {
+					if err := turbo.SetEnabled(enabled); err != nil {
+						t.Fatal(err)
+					}
+					if got, err := turbo.Enabled(); err != nil || got != enabled {
+						t.Errorf("%s: Enabled() = %v, %v; want %v", turbo.Path(), got, err, enabled)
+					}
+				}
+				if len(turbos) == 0 {
+					continue
+				}
+				for cpu := 0; cpu < test.layout.CPUs; cpu++ {
+					if got, err := cpupowertest.TurboEnabled(root, cpu); err != nil || got != enabled {
+						t.Errorf("cpu%d: turbo enabled = %v, %v; want %v", cpu, got, err, enabled)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGovernor(t *testing.T) {
+	root := useSysfs(t, cpupowertest.ACPI)
+	domains, err := cpupower.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := domains[1]
+	if gov, err := d.Governor(); err != nil || gov != "schedutil" {
+		t.Fatalf("Governor() = %q, %v; want schedutil", gov, err)
+	}
+	if err := d.SetGovernor("turbo"); err == nil {
+		t.Errorf("SetGovernor(turbo) succeeded; want error")
+	}
+	if err := d.SetGovernor("userspace"); err != nil {
+		t.Fatal(err)
+	}
+	if gov, err := cpupowertest.Governor(root, 2); err != nil || gov != "userspace" {
+		t.Errorf("cpu2 governor = %q, %v; want userspace", gov, err)
+	}
+	if err := d.SetSpeed(1600000); err != nil {
+		t.Fatal(err)
+	}
+	if speed, err := d.Speed(); err != nil || speed != 1600000 {
+		t.Errorf("Speed() = %d, %v; want 1600000", speed, err)
+	}
+}
+
+func TestPState(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		layout  cpupowertest.Layout
+		pstate  string
+		perfPct bool
+	}{
+		{"pstate", cpupowertest.PState, "intel_pstate", true},
+		{"acpi", cpupowertest.ACPI, "", false},
+		{"amd", cpupowertest.AMD, "amd_pstate", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root := useSysfs(t, test.layout)
+			domains, err := cpupower.Domains()
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := domains[0]
+			if driver, err := d.Driver(); err != nil || driver != test.layout.Driver {
+				t.Errorf("Driver() = %q, %v; want %q", driver, err, test.layout.Driver)
+			}
+
+			p, err := cpupower.FindPState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.pstate == "" {
+				if p != nil {
+					t.Errorf("FindPState() = %s; want nil", p.Path())
+				}
+				if _, err := d.EPP(); err == nil {
+					t.Errorf("EPP() succeeded; want error")
+				}
+				return
+			}
+			if p == nil {
+				t.Fatalf("FindPState() = nil; want %s", test.pstate)
+			}
+			if p.Name() != test.pstate {
+				t.Errorf("Name() = %q; want %q", p.Name(), test.pstate)
+			}
+			if status, err := p.Status(); err != nil || status != "active" {
+				t.Errorf("Status() = %q, %v; want active", status, err)
+			}
+			if err := p.SetStatus("passive"); err != nil {
+				t.Fatal(err)
+			}
+			if status, err := p.Status(); err != nil || status != "passive" {
+				t.Errorf("after SetStatus, Status() = %q, %v; want passive", status, err)
+			}
+			if p.HasPerfPct() != test.perfPct {
+				t.Errorf("HasPerfPct() = %v; want %v", p.HasPerfPct(), test.perfPct)
+			}
+			if test.perfPct {
+				if err := p.SetPerfPct(10, 60); err != nil {
+					t.Fatal(err)
+				}
+				if min, max, err := cpupowertest.PerfPct(root); err != nil || min != 10 || max != 60 {
+					t.Errorf("perf pct = %d, %d, %v; want 10, 60", min, max, err)
+				}
+				if err := p.SetPerfPct(60, 10); err == nil {
+					t.Errorf("SetPerfPct(60, 10) succeeded; want error")
+				}
+			}
+
+			if avail, err := d.AvailableEPPs(); err != nil || !reflect.DeepEqual(avail, cpupowertest.EPPs) {
+				t.Errorf("AvailableEPPs() = %v, %v; want %v", avail, err, cpupowertest.EPPs)
+			}
+			if err := d.SetEPP("performance"); err != nil {
+				t.Fatal(err)
+			}
+			if epp, err := d.EPP(); err != nil || epp != "performance" {
+				t.Errorf("EPP() = %q, %v; want performance", epp, err)
+			}
+			if epp, err := cpupowertest.EPP(root, 1); err != nil || epp != cpupowertest.EPPs[2] {
+				t.Errorf("cpu1 EPP = %q, %v; want unchanged", epp, err)
+			}
+		})
+	}
+}
+
+func TestFrequencySampler(t *testing.T) {
+	// Without a base frequency, the sampler uses scaling_cur_freq.
+	root := useSysfs(t, cpupowertest.ACPI)
+	domains, err := cpupower.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := domains[1].NewFrequencySampler()
+	defer s.Close()
+	if s.Source() != "scaling_cur_freq" {
+		t.Errorf("Source() = %q; want scaling_cur_freq", s.Source())
+	}
+	if err := cpupowertest.SetCurFreq(root, 2, 1600000); err != nil {
+		t.Fatal(err)
+	}
+	if freq, ok, err := s.Sample(); err != nil || !ok || freq != 1600000 {
+		t.Errorf("Sample() = %d, %v, %v; want 1600000, true, nil", freq, ok, err)
+	}
+
+	// Without the msr driver, it falls back to scaling_cur_freq
+	// even if it knows the base frequency.
+	layout := cpupowertest.ACPI
+	layout.BaseFreq = 2000000
+	useSysfs(t, layout)
+	old := cpupower.DevRoot
+	cpupower.DevRoot = t.TempDir()
+	t.Cleanup(func() { cpupower.DevRoot = old })
+	if domains, err = cpupower.Domains(); err != nil {
+		t.Fatal(err)
+	}
+	if base, err := domains[0].BaseFrequency(); err != nil || base != 2000000 {
+		t.Errorf("BaseFrequency() = %d, %v; want 2000000, nil", base, err)
+	}
+	s = domains[0].NewFrequencySampler()
+	defer s.Close()
+	if s.Source() != "scaling_cur_freq" {
+		t.Errorf("Source() = %q; want scaling_cur_freq", s.Source())
+	}
+	if freq, ok, err := s.Sample(); err != nil || !ok || freq != layout.Max {
+		t.Errorf("Sample() = %d, %v, %v; want %d, true, nil", freq, ok, err, layout.Max)
+	}
+}
+
+func TestThermal(t *testing.T) {
+	root := useSysfs(t, cpupowertest.PState)
+	if err := cpupowertest.SetThrottleCounts(root, 2, 5, 7); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := cpupower.ThrottleCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cpupower.ThrottleCount{
+		{CPU: 0}, {CPU: 1}, {CPU: 2, CoreThrottles: 5, PackageThrottles: 7}, {CPU: 3},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("ThrottleCounts() = %+v; want %+v", counts, want)
+	}
+	zones, err := cpupower.ThermalZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []cpupower.ThermalZone{{"thermal_zone0", "x86_pkg_temp", cpupowertest.Temp}}; !reflect.DeepEqual(zones, want) {
+		t.Errorf("ThermalZones() = %+v; want %+v", zones, want)
+	}
+
+	// Hosts without these report nothing.
+	useSysfs(t, cpupowertest.ACPI)
+	if counts, err := cpupower.ThrottleCounts(); err != nil || counts != nil {
+		t.Errorf("ThrottleCounts() = %+v, %v; want nil, nil", counts, err)
+	}
+	if zones, err := cpupower.ThermalZones(); err != nil || zones != nil {
+		t.Errorf("ThermalZones() = %+v, %v; want nil, nil", zones, err)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cpupowertest builds simulated sysfs trees for testing code
+// that uses package cpupower without real hardware or privileges.
+package cpupowertest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Layout describes the CPUs of a simulated host.
+type Layout struct {
+	// CPUs is the number of CPUs.
+	CPUs int
+
+	// DomainSize is the number of consecutive CPUs that share a
+	// cpufreq policy. If it is 0, each CPU has its own policy.
+	DomainSize int
+
+	// Legacy makes the tree lack cpufreq policy directories, as
+	// on older kernels. Instead, each CPU has its own cpufreq
+	// directory, and if DomainSize is non-zero, CPUs that share a
+	// domain list each other in freqdomain_cpus.
+	Legacy bool
+
+	// Min and Max are the hardware frequency limits, in kHz.
+	Min, Max int
+
+	// Available lists the frequencies the CPUs can be set to, in
+	// kHz, or is nil if the driver accepts any frequency between
+	// Min and Max.
+	Available []int
+
+	// Turbo is the kind of turbo boost control the host has, or
+	// "" for none. Turbo starts enabled.
+	Turbo string
+
+	// Governors lists the available scaling governors. The CPUs
+	// start with the first one. If Governors is empty, the tree
+	// has no scaling governor files.
+	Governors []string
+
+	// Driver is the cpufreq driver, or "" for none. The
+	// intel_pstate and amd-pstate-epp drivers start in active
+	// mode with energy performance preferences, and intel_pstate
+	// also has global performance limits.
+	Driver string
+
+	// BaseFreq is the frequency the CPUs run at without turbo
+	// boost, in kHz, or 0 if the driver doesn't report it.
+	BaseFreq int
+
+	// Thermal gives the CPUs thermal throttling counts, which
+	// start at 0, and gives the host a thermal zone for each
+	// package, which starts at Temp.
+	Thermal bool
+}
+
+// Temp is the starting temperature of simulated thermal zones, in
+// millidegrees Celsius.
+const Temp = 45000
+
+// EPPs are the energy performance preferences of the simulated
+// P-state drivers. The CPUs start with the third one.
+var EPPs = []string{"default", "performance", "balance_performance", "balance_power", "power"}
+
+// Kinds of turbo boost controls, for Layout.Turbo.
+const (
+	// TurboIntel is intel_pstate's global no_turbo setting.
+	TurboIntel = "intel_pstate"
+	// TurboBoost is cpufreq's global boost setting.
+	TurboBoost = "boost"
+	// TurboPolicy is a boost setting for each frequency domain,
+	// as amd-pstate provides.
+	TurboPolicy = "policy"
+)
+
+// Some common layouts.
+var (
+	// PState is a host using the intel_pstate driver, which
+	// accepts any frequency in range.
+	PState = Layout{CPUs: 4, Min: 800000, Max: 3600000, Turbo: TurboIntel,
+		Governors: []string{"powersave", "performance"}, Driver: "intel_pstate", Thermal: true}
+
+	// ACPI is a host using the acpi-cpufreq driver, with a fixed
+	// set of frequencies and pairs of CPUs sharing a frequency
+	// domain.
+	ACPI = Layout{CPUs: 4, DomainSize: 2, Min: 1200000, Max: 2400000,
+		Available: []int{2400000, 2000000, 1600000, 1200000}, Turbo: TurboBoost,
+		Governors: []string{"schedutil", "conservative", "ondemand", "userspace", "powersave", "performance"},
+		Driver:    "acpi-cpufreq"}
+
+	// AMD is a host using the amd-pstate driver, with a turbo
+	// boost setting for each CPU.
+	AMD = Layout{CPUs: 4, Min: 400000, Max: 4500000, Turbo: TurboPolicy,
+		Governors: []string{"powersave", "performance"}, Driver: "amd-pstate-epp"}
+
+	// Single is a host with one CPU.
+	Single = Layout{CPUs: 1, Min: 1000000, Max: 2000000}
+)
+
+// Build creates a simulated sysfs tree with layout l under root, for
+// use as cpupower.SysfsRoot. Each CPU's current frequency range
+// starts as its full range.
+func Build(root string, l Layout) error {
+	dir := filepath.Join(root, "devices/system/cpu")
+	// Real sysfs has other files and directories alongside the
+	// CPUs.
+	if err := os.MkdirAll(filepath.Join(dir, "cpuidle"), 0755); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, "online"), fmt.Sprintf("0-%d", l.CPUs-1)); err != nil {
+		return err
+	}
+	switch l.Turbo {
+	case "", TurboPolicy:
+	case TurboIntel:
+		if err := os.MkdirAll(filepath.Join(dir, "intel_pstate"), 0755); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(dir, "intel_pstate/no_turbo"), "0"); err != nil {
+			return err
+		}
+	case TurboBoost:
+		if err := os.MkdirAll(filepath.Join(dir, "cpufreq"), 0755); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(dir, "cpufreq/boost"), "1"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown turbo control %q", l.Turbo)
+	}
+	pstate := map[string]string{}
+	switch l.Driver {
+	case "intel_pstate":
+		pstate["intel_pstate/status"] = "active"
+		pstate["intel_pstate/min_perf_pct"] = strconv.Itoa(l.Min * 100 / l.Max)
+		pstate["intel_pstate/max_perf_pct"] = "100"
+	case "amd-pstate-epp":
+		pstate["amd_pstate/status"] = "active"
+	}
+	for name, data := range pstate {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(dir, name), data); err != nil {
+			return err
+		}
+	}
+
+	if l.Thermal {
+		for cpu := 0; cpu < l.CPUs; cpu++ {
+			cdir := filepath.Join(dir, fmt.Sprintf("cpu%d", cpu))
+			if err := writeFiles(filepath.Join(cdir, "thermal_throttle"), map[string]string{
+				"core_throttle_count":    "0",
+				"package_throttle_count": "0",
+			}); err != nil {
+				return err
+			}
+			if err := writeFiles(filepath.Join(cdir, "topology"), map[string]string{"physical_package_id": "0"}); err != nil {
+				return err
+			}
+		}
+		if err := writeFiles(filepath.Join(root, "class/thermal/thermal_zone0"), map[string]string{
+			"type": "x86_pkg_temp",
+			"temp": strconv.Itoa(Temp),
+		}); err != nil {
+			return err
+		}
+	}
+
+	size := l.DomainSize
+	if size == 0 {
+		size = 1
+	}
+	for first := 0; first < l.CPUs; first += size {
+		var cpus []int
+		for c := first; c < first+size && c < l.CPUs; c++ {
+			cpus = append(cpus, c)
+		}
+		files := map[string]string{
+			"cpuinfo_min_freq": strconv.Itoa(l.Min),
+			"cpuinfo_max_freq": strconv.Itoa(l.Max),
+			"scaling_min_freq": strconv.Itoa(l.Min),
+			"scaling_max_freq": strconv.Itoa(l.Max),
+			"scaling_cur_freq": strconv.Itoa(l.Max),
+		}
+		if l.BaseFreq != 0 {
+			files["base_frequency"] = strconv.Itoa(l.BaseFreq)
+		}
+		if l.Available != nil {
+			files["scaling_available_frequencies"] = joinInts(l.Available) + " "
+		}
+		if l.Turbo == TurboPolicy {
+			files["boost"] = "1"
+		}
+		if len(l.Governors) > 0 {
+			files["scaling_governor"] = l.Governors[0]
+			files["scaling_available_governors"] = strings.Join(l.Governors, " ")
+			// Like the kernel, report a speed only for the
+			// userspace governor.
+			files["scaling_setspeed"] = "<unsupported>"
+			if l.Governors[0] == "userspace" {
+				files["scaling_setspeed"] = strconv.Itoa(l.Max)
+			}
+		}
+		if l.Driver != "" {
+			files["scaling_driver"] = l.Driver
+		}
+		if len(pstate) > 0 {
+			files["energy_performance_preference"] = EPPs[2]
+			files["energy_performance_available_preferences"] = strings.Join(EPPs, " ") + " "
+		}
+
+		if l.Legacy {
+			if l.DomainSize > 0 {
+				files["freqdomain_cpus"] = joinInts(cpus)
+			}
+			for _, cpu := range cpus {
+				if err := writeFiles(CPUFreqDir(root, cpu), files); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Like the kernel, put the settings in a policy
+		// directory and link each CPU's cpufreq directory to
+		// it.
+		files["related_cpus"] = joinInts(cpus)
+		files["affected_cpus"] = joinInts(cpus)
+		policy := fmt.Sprintf("policy%d", first)
+		if err := writeFiles(filepath.Join(dir, "cpufreq", policy), files); err != nil {
+			return err
+		}
+		for _, cpu := range cpus {
+			pdir := CPUFreqDir(root, cpu)
+			if err := os.MkdirAll(filepath.Dir(pdir), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(filepath.Join("../cpufreq", policy), pdir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFiles creates directory dir containing files.
+func writeFiles(dir string, files map[string]string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if err := writeFile(filepath.Join(dir, name), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CPUFreqDir returns the cpufreq directory of CPU cpu in the tree at
+// root. Unless the tree is a Legacy one, this links to the CPU's
+// policy directory.
+func CPUFreqDir(root string, cpu int) string {
+	return filepath.Join(root, "devices/system/cpu", fmt.Sprintf("cpu%d", cpu), "cpufreq")
+}
+
+// ReadRange returns the current frequency range of CPU cpu in the
+// tree at root.
+func ReadRange(root string, cpu int) (min, max int, err error) {
+	pdir := CPUFreqDir(root, cpu)
+	if min, err = readInt(filepath.Join(pdir, "scaling_min_freq")); err != nil {
+		return 0, 0, err
+	}
+	if max, err = readInt(filepath.Join(pdir, "scaling_max_freq")); err != nil {
+		return 0, 0, err
+	}
+	return min, max, nil
+}
+
+// TurboEnabled returns whether turbo boost is enabled for CPU cpu in
+// the tree at root.
+func TurboEnabled(root string, cpu int) (bool, error) {
+	dir := filepath.Join(root, "devices/system/cpu")
+	if v, err := readInt(filepath.Join(dir, "intel_pstate/no_turbo")); err == nil {
+		return v == 0, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if v, err := readInt(filepath.Join(dir, "cpufreq/boost")); err == nil {
+		return v != 0, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	v, err := readInt(filepath.Join(CPUFreqDir(root, cpu), "boost"))
+	if err != nil {
+		return false, err
+	}
+	return v != 0, nil
+}
+
+// Governor returns the scaling governor of CPU cpu in the tree at
+// root.
+func Governor(root string, cpu int) (string, error) {
+	data, err := os.ReadFile(filepath.Join(CPUFreqDir(root, cpu), "scaling_governor"))
+	return strings.TrimSpace(string(data)), err
+}
+
+// EPP returns the energy performance preference of CPU cpu in the
+// tree at root.
+func EPP(root string, cpu int) (string, error) {
+	data, err := os.ReadFile(filepath.Join(CPUFreqDir(root, cpu), "energy_performance_preference"))
+	return strings.TrimSpace(string(data)), err
+}
+
+// PStateStatus returns the operation mode of the intel_pstate or
+// amd-pstate driver in the tree at root.
+func PStateStatus(root string) (string, error) {
+	for _, name := range []string{"intel_pstate", "amd_pstate"} {
+		data, err := os.ReadFile(filepath.Join(root, "devices/system/cpu", name, "status"))
+		if !os.IsNotExist(err) {
+			return strings.TrimSpace(string(data)), err
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// PerfPct returns the intel_pstate global performance limits in the
+// tree at root.
+func PerfPct(root string) (min, max int, err error) {
+	dir := filepath.Join(root, "devices/system/cpu/intel_pstate")
+	if min, err = readInt(filepath.Join(dir, "min_perf_pct")); err != nil {
+		return 0, 0, err
+	}
+	if max, err = readInt(filepath.Join(dir, "max_perf_pct")); err != nil {
+		return 0, 0, err
+	}
+	return min, max, nil
+}
+
+// SetCurFreq sets the frequency the kernel reports for CPU cpu in
+// the tree at root.
+func SetCurFreq(root string, cpu, freq int) error {
+	return writeFile(filepath.Join(CPUFreqDir(root, cpu), "scaling_cur_freq"), strconv.Itoa(freq))
+}
+
+// SetThrottleCounts sets the core and package thermal throttling
+// counts of CPU cpu in the tree at root.
+func SetThrottleCounts(root string, cpu int, core, pkg uint64) error {
+	dir := filepath.Join(root, "devices/system/cpu", fmt.Sprintf("cpu%d", cpu), "thermal_throttle")
+	if err := writeFile(filepath.Join(dir, "core_throttle_count"), strconv.FormatUint(core, 10)); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "package_throttle_count"), strconv.FormatUint(pkg, 10))
+}
+
+// ThermalZoneDir returns the directory of thermal zone zone in the
+// tree at root.
+func ThermalZoneDir(root string, zone int) string {
+	return filepath.Join(root, "class/thermal", fmt.Sprintf("thermal_zone%d", zone))
+}
+
+func writeFile(path, data string) error {
+	return os.WriteFile(path, []byte(data+"\n"), 0644)
+}
+
+func readInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func joinInts(xs []int) string {
+	strs := make([]string, len(xs))
+	for i, x := range xs {
+		strs[i] = strconv.Itoa(x)
+	}
+	return strings.Join(strs, " ")
+}
@@ -0,0 +1,144 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpupower
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DevRoot is the directory device files are in. Tests can point this
+// at a simulated tree.
+var DevRoot = "/dev"
+
+// Addresses of the APERF and MPERF model-specific registers. MPERF
+// counts at the CPU's base frequency and APERF at its actual
+// frequency, both only while the CPU is running.
+const (
+	msrMPERF = 0xe7
+	msrAPERF = 0xe8
+)
+
+// CurrentFrequency returns the kernel's most recent measurement of
+// this domain's frequency, in kHz.
+func (d *Domain) CurrentFrequency() (int, error) {
+	return readInt(filepath.Join(d.path, "scaling_cur_freq"))
+}
+
+// BaseFrequency returns the frequency this domain's CPUs run at
+// without turbo boost, in kHz, if the driver reports it (as
+// intel_pstate does).
+func (d *Domain) BaseFrequency() (int, error) {
+	return readInt(filepath.Join(d.path, "base_frequency"))
+}
+
+// FrequencySampler measures the frequency a domain's CPUs actually
+// run at.
+type FrequencySampler struct {
+	d *Domain
+
+	// If the sampler uses APERF and MPERF, msrs are the msr
+	// devices of the domain's CPUs and aperf and mperf are their
+	// counts at the last sample.
+	base         int
+	msrs         []*os.File
+	aperf, mperf []uint64
+}
+
+// NewFrequencySampler returns a sampler for d. If the driver reports
+// the domain's base frequency and the msr driver is loaded, the
+// sampler uses the CPUs' APERF and MPERF registers to measure their
+// average frequency while running. Otherwise, it samples the
+// kernel's scaling_cur_freq.
+func (d *Domain) NewFrequencySampler() *FrequencySampler {
+	s := &FrequencySampler{d: d}
+	base, err := d.BaseFrequency()
+	if err != nil {
+		return s
+	}
+	for _, cpu := range d.cpus {
+		f, err := os.Open(filepath.Join(DevRoot, "cpu", fmt.Sprint(cpu), "msr"))
+		if err != nil {
+			// Fall back to scaling_cur_freq.
+			s.Close()
+			return s
+		}
+		s.msrs = append(s.msrs, f)
+	}
+	s.base = base
+	s.aperf = make([]uint64, len(s.msrs))
+	s.mperf = make([]uint64, len(s.msrs))
+	if err := s.read(s.aperf, s.mperf); err != nil {
+		// The CPUs may not have these registers.
+		s.Close()
+		return s
+	}
+	return s
+}
+
+// Source returns how s measures frequency, either "APERF/MPERF" or
+// "scaling_cur_freq".
+func (s *FrequencySampler) Source() string {
+	if s.msrs != nil {
+		return "APERF/MPERF"
+	}
+	return "scaling_cur_freq"
+}
+
+// Sample returns the domain's frequency in kHz. Using APERF and
+// MPERF, this is the average frequency of the domain's CPUs while
+// they were running since the previous sample, and ok is false if
+// none of them ran. Otherwise, it is the current frequency.
+func (s *FrequencySampler) Sample() (freq int, ok bool, err error) {
+	if s.msrs == nil {
+		freq, err := s.d.CurrentFrequency()
+		return freq, err == nil, err
+	}
+	aperf := make([]uint64, len(s.msrs))
+	mperf := make([]uint64, len(s.msrs))
+	if err := s.read(aperf, mperf); err != nil {
+		return 0, false, err
+	}
+	var da, dm uint64
+	for i := range s.msrs {
+		da += aperf[i] - s.aperf[i]
+		dm += mperf[i] - s.mperf[i]
+	}
+	s.aperf, s.mperf = aperf, mperf
+	if dm == 0 {
+		return 0, false, nil
+	}
+	return int(float64(s.base) * float64(da) / float64(dm)), true, nil
+}
+
+// read reads the APERF and MPERF counts of each CPU.
+func (s *FrequencySampler) read(aperf, mperf []uint64) error {
+	var buf [8]byte
+	for i, f := range s.msrs {
+		if _, err := f.ReadAt(buf[:], msrAPERF); err != nil {
+			return err
+		}
+		aperf[i] = binary.LittleEndian.Uint64(buf[:])
+		if _, err := f.ReadAt(buf[:], msrMPERF); err != nil {
+			return err
+		}
+		mperf[i] = binary.LittleEndian.Uint64(buf[:])
+	}
+	return nil
+}
+
+// Close releases the resources of s.
+func (s *FrequencySampler) Close() error {
+	var err error
+	for _, f := range s.msrs {
+		if err1 := f.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	s.msrs = nil
+	return err
+}
@@ -0,0 +1,58 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpupower
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Governor returns the name of the scaling governor this domain is
+// using, such as "schedutil" or "performance".
+func (d *Domain) Governor() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.path, "scaling_governor"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// AvailableGovernors returns the names of the scaling governors this
+// domain can use.
+func (d *Domain) AvailableGovernors() ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.path, "scaling_available_governors"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// SetGovernor sets this domain's scaling governor. It returns an
+// error if the governor is not one of AvailableGovernors.
+func (d *Domain) SetGovernor(name string) error {
+	avail, err := d.AvailableGovernors()
+	if err != nil {
+		return err
+	}
+	for _, a := range avail {
+		if a == name {
+			return ioutil.WriteFile(filepath.Join(d.path, "scaling_governor"), []byte(name), 0)
+		}
+	}
+	return fmt.Errorf("%s: governor %q not available (have %s)", d.Name(), name, strings.Join(avail, ", "))
+}
+
+// Speed returns the frequency set for the "userspace" governor. It
+// returns an error if the domain is using another governor.
+func (d *Domain) Speed() (int, error) {
+	return readInt(filepath.Join(d.path, "scaling_setspeed"))
+}
+
+// SetSpeed sets the frequency for the "userspace" governor.
+func (d *Domain) SetSpeed(freq int) error {
+	return writeInt(filepath.Join(d.path, "scaling_setspeed"), freq)
+}
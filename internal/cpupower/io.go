@@ -19,6 +19,14 @@ func readInt(path string) (int, error) {
 	return strconv.Atoi(strings.TrimSpace(string(data)))
 }
 
+func readUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
 func writeInt(path string, val int) error {
 	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d", val)), 0)
 }
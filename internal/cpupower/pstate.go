@@ -0,0 +1,146 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpupower
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Driver returns the name of the cpufreq driver for this domain, such
+// as "intel_pstate", "amd-pstate-epp", or "acpi-cpufreq".
+func (d *Domain) Driver() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.path, "scaling_driver"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// EPP returns this domain's energy performance preference, such as
+// "balance_performance". Drivers that manage frequency in hardware
+// (intel_pstate and amd-pstate in active mode) use this to bias their
+// choice of frequency within the domain's range.
+func (d *Domain) EPP() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.path, "energy_performance_preference"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// AvailableEPPs returns the energy performance preferences this
+// domain accepts.
+func (d *Domain) AvailableEPPs() ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.path, "energy_performance_available_preferences"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// SetEPP sets this domain's energy performance preference. Drivers
+// reject any preference other than "performance" while the domain is
+// using the performance governor.
+func (d *Domain) SetEPP(pref string) error {
+	return ioutil.WriteFile(filepath.Join(d.path, "energy_performance_preference"), []byte(pref), 0)
+}
+
+// PState is the global control of a P-state driver, either
+// intel_pstate or amd-pstate.
+type PState struct {
+	dir string
+}
+
+// FindPState returns the P-state driver control of this host, or nil
+// if the host uses neither intel_pstate nor amd-pstate.
+func FindPState() (*PState, error) {
+	for _, name := range []string{"intel_pstate", "amd_pstate"} {
+		dir := filepath.Join(SysfsRoot, "devices/system/cpu", name)
+		if _, err := os.Stat(filepath.Join(dir, "status")); err == nil {
+			return &PState{dir}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// NewPState returns the P-state driver control at path, which must
+// be a path returned by the Path method of a control from FindPState.
+func NewPState(path string) *PState {
+	return &PState{path}
+}
+
+// Path returns the sysfs directory of this control.
+func (p *PState) Path() string {
+	return p.dir
+}
+
+// Name returns the name of the driver, "intel_pstate" or
+// "amd_pstate".
+func (p *PState) Name() string {
+	return filepath.Base(p.dir)
+}
+
+// Status returns the operation mode of the driver. This is "active"
+// if the driver (or hardware) picks frequencies itself, "passive" or
+// "guided" if it works under a cpufreq governor, or "off" or
+// "disable" if it is not in use.
+func (p *PState) Status() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p.dir, "status"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SetStatus sets the operation mode of the driver. Changing the mode
+// resets the frequency ranges, governors, and energy performance
+// preferences of all domains.
+func (p *PState) SetStatus(status string) error {
+	return ioutil.WriteFile(filepath.Join(p.dir, "status"), []byte(status), 0)
+}
+
+// HasPerfPct returns whether the driver has global performance
+// limits, as intel_pstate does.
+func (p *PState) HasPerfPct() bool {
+	_, err := os.Stat(filepath.Join(p.dir, "max_perf_pct"))
+	return err == nil
+}
+
+// PerfPct returns the driver's global performance limits, as
+// percentages of the maximum performance. These apply on top of
+// each domain's frequency range.
+func (p *PState) PerfPct() (min, max int, err error) {
+	if min, err = readInt(filepath.Join(p.dir, "min_perf_pct")); err != nil {
+		return 0, 0, err
+	}
+	if max, err = readInt(filepath.Join(p.dir, "max_perf_pct")); err != nil {
+		return 0, 0, err
+	}
+	return min, max, nil
+}
+
+// SetPerfPct sets the driver's global performance limits. The driver
+// clamps them to the limits of the hardware.
+func (p *PState) SetPerfPct(min, max int) error {
+	if min > max {
+		return fmt.Errorf("empty performance range %d%%-%d%%", min, max)
+	}
+	// The driver keeps min <= max, so as in SetRange, try both
+	// orders.
+	err1 := writeInt(filepath.Join(p.dir, "min_perf_pct"), min)
+	if err2 := writeInt(filepath.Join(p.dir, "max_perf_pct"), max); err2 != nil {
+		return err2
+	}
+	if err1 != nil {
+		err1 = writeInt(filepath.Join(p.dir, "min_perf_pct"), min)
+	}
+	return err1
+}
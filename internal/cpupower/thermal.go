@@ -0,0 +1,107 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpupower
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ThrottleCount is the number of times a CPU has been thermally
+// throttled since boot.
+type ThrottleCount struct {
+	CPU int
+	// Package is the CPU's physical package ID. All CPUs in a
+	// package report the same PackageThrottles.
+	Package int
+
+	CoreThrottles, PackageThrottles uint64
+}
+
+// ThrottleCounts returns the thermal throttling counts of each CPU,
+// or nil if the host doesn't report them. Only Intel CPUs report
+// them.
+func ThrottleCounts() ([]ThrottleCount, error) {
+	dir := filepath.Join(SysfsRoot, "devices/system/cpu")
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []ThrottleCount
+	for _, f := range fs {
+		m := cpuRe.FindStringSubmatch(f.Name())
+		if !f.IsDir() || m == nil {
+			continue
+		}
+		cdir := filepath.Join(dir, f.Name())
+		core, err := readUint(filepath.Join(cdir, "thermal_throttle/core_throttle_count"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		c := ThrottleCount{CoreThrottles: core}
+		c.CPU, _ = strconv.Atoi(m[1])
+		if c.PackageThrottles, err = readUint(filepath.Join(cdir, "thermal_throttle/package_throttle_count")); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if c.Package, err = readInt(filepath.Join(cdir, "topology/physical_package_id")); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].CPU < counts[j].CPU })
+	return counts, nil
+}
+
+// ThermalZone is a temperature sensor.
+type ThermalZone struct {
+	// Name is the zone's sysfs name, such as "thermal_zone0",
+	// and Type describes it, such as "x86_pkg_temp".
+	Name, Type string
+	// Temp is the temperature in millidegrees Celsius.
+	Temp int
+}
+
+var thermalZoneRe = regexp.MustCompile(`^thermal_zone\d+$`)
+
+// ThermalZones returns the host's thermal zones and their current
+// temperatures. It omits zones that can't report their temperature.
+func ThermalZones() ([]ThermalZone, error) {
+	dir := filepath.Join(SysfsRoot, "class/thermal")
+	fs, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var zones []ThermalZone
+	for _, f := range fs {
+		// Entries in /sys/class are symlinks.
+		if !thermalZoneRe.MatchString(f.Name()) {
+			continue
+		}
+		zdir := filepath.Join(dir, f.Name())
+		temp, err := readInt(filepath.Join(zdir, "temp"))
+		if err != nil {
+			// Some sensors fail to read while they're
+			// powered down.
+			continue
+		}
+		typ, err := ioutil.ReadFile(filepath.Join(zdir, "type"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		zones = append(zones, ThermalZone{f.Name(), strings.TrimSpace(string(typ)), temp})
+	}
+	return zones, nil
+}
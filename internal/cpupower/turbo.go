@@ -0,0 +1,85 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpupower
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Turbo is a control for turbo boost, which lets CPUs run above
+// their base frequency when power and thermal limits allow.
+type Turbo struct {
+	path string
+	// inverted indicates that writing 1 disables turbo, as for
+	// intel_pstate's no_turbo.
+	inverted bool
+}
+
+// TurboControls returns the turbo boost controls of this host, or nil
+// if it has none. If the host has a global control (intel_pstate's
+// no_turbo or cpufreq's boost), that is the only control. Otherwise,
+// there is one control for each frequency domain that has one, such
+// as AMD's per-policy boost or legacy cpb setting.
+func TurboControls() ([]*Turbo, error) {
+	dir := filepath.Join(SysfsRoot, "devices/system/cpu")
+	for _, path := range []string{
+		filepath.Join(dir, "intel_pstate/no_turbo"),
+		filepath.Join(dir, "cpufreq/boost"),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return []*Turbo{NewTurbo(path)}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	domains, err := Domains()
+	if err != nil {
+		return nil, err
+	}
+	var turbos []*Turbo
+	for _, d := range domains {
+		for _, name := range []string{"boost", "cpb"} {
+			path := filepath.Join(d.path, name)
+			if _, err := os.Stat(path); err == nil {
+				turbos = append(turbos, NewTurbo(path))
+				break
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return turbos, nil
+}
+
+// NewTurbo returns the turbo control at path, which must be a path
+// returned by the Path method of a control from TurboControls.
+func NewTurbo(path string) *Turbo {
+	return &Turbo{path, filepath.Base(path) == "no_turbo"}
+}
+
+// Path returns the sysfs file of this control.
+func (t *Turbo) Path() string {
+	return t.path
+}
+
+// Enabled returns whether turbo boost is enabled.
+func (t *Turbo) Enabled() (bool, error) {
+	v, err := readInt(t.path)
+	if err != nil {
+		return false, err
+	}
+	return (v != 0) != t.inverted, nil
+}
+
+// SetEnabled enables or disables turbo boost.
+func (t *Turbo) SetEnabled(enabled bool) error {
+	v := 0
+	if enabled != t.inverted {
+		v = 1
+	}
+	return writeInt(t.path, v)
+}